@@ -0,0 +1,62 @@
+package kegerator
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	DefaultArchiveLogSize = 1 << 20 // bytes written before the log is rotated
+
+	defaultArchiveMemory = 20 // most recent archived kegs kept in the state file
+)
+
+// GlobalArchiveLog records the totals of every refilled or replaced keg to
+// disk. If it is nil, only the most recent are kept in the state file
+var GlobalArchiveLog *ArchiveLog
+
+// ArchiveLog appends archived keg totals to archive.jsonl in its directory.
+// Kegs are refilled rarely, so rotated logs are never removed
+type ArchiveLog struct {
+	log *jsonLog
+}
+
+// NewArchiveLog opens the archive log in dir, creating the directory if
+// necessary. The log is rotated once it exceeds maxSize bytes
+func NewArchiveLog(dir string, maxSize int64, clock Clock) (*ArchiveLog, error) {
+	l, err := openJSONLog(dir, "archive", maxSize, 0, clock)
+	if err != nil {
+		return nil, err
+	}
+	return &ArchiveLog{log: l}, nil
+}
+
+// Append writes archived keg totals to the log
+func (l *ArchiveLog) Append(archive KegArchive) error {
+	return l.log.append(archive)
+}
+
+// List returns the archived keg totals in the log since from, oldest first
+func (l *ArchiveLog) List(from time.Time) ([]KegArchive, error) {
+	var archives []KegArchive
+	err := l.log.read(from, func(data []byte) error {
+		var archive KegArchive
+		err := json.Unmarshal(data, &archive)
+		if err != nil {
+			return err
+		}
+		if !archive.Time.Before(from) {
+			archives = append(archives, archive)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return archives, nil
+}
+
+// Close closes the log
+func (l *ArchiveLog) Close() error {
+	return l.log.close()
+}
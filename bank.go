@@ -0,0 +1,172 @@
+package kegerator
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/warthog618/gpiod"
+)
+
+// GPIOBank requests the lines for every flow meter on a gpio chip with a single
+// request. Events from all lines are read by one event handler and dispatched
+// to the pulse source for the line they occurred on
+//
+// The lines are released once every pulse source in the bank has been closed,
+// or when the bank itself is closed
+type GPIOBank struct {
+	chip    string
+	lines   *gpiod.Lines
+	clock   eventClock
+	sources map[int]*bankPulseSource // by line offset
+
+	mu     sync.Mutex
+	open   int // pulse sources not yet closed
+	closed bool
+}
+
+// NewGPIOBank requests the provided lines on chip for input and begins watching
+// them for events. Each line is configured according to its LineConfig, though
+// the chip specified by each line is ignored
+func NewGPIOBank(chip string, lines []FlowLine) (*GPIOBank, error) {
+	bank := &GPIOBank{
+		chip:    chip,
+		sources: make(map[int]*bankPulseSource, len(lines)),
+		open:    len(lines),
+	}
+
+	pins := make([]int, len(lines))
+	for i, line := range lines {
+		if _, ok := bank.sources[line.Pin]; ok {
+			return nil, fmt.Errorf("duplicate pin %d", line.Pin)
+		}
+		bank.sources[line.Pin] = &bankPulseSource{
+			bank:  bank,
+			pin:   line.Pin,
+			seqno: seqnoCounter{pin: line.Pin},
+		}
+		pins[i] = line.Pin
+	}
+
+	err := bank.request(pins, lines, true)
+	if err != nil && debounced(lines) {
+		log.Printf("WARN: %s: kernel debounce unavailable: %s\n", chip, err)
+		err = bank.request(pins, lines, false)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("request pins %v failed: %w", pins, err)
+	}
+
+	return bank, nil
+}
+
+func (b *GPIOBank) request(pins []int, lines []FlowLine, debounce bool) error {
+	options := []gpiod.LineReqOption{
+		gpiod.AsInput,
+		gpiod.WithEventHandler(b.dispatch),
+	}
+	for _, line := range lines {
+		var lineOptions []gpiod.SubsetLineConfigOption
+		for _, option := range line.options(debounce) {
+			lineOptions = append(lineOptions, option)
+		}
+		options = append(options, gpiod.WithLines([]int{line.Pin}, lineOptions...))
+	}
+
+	return requestWithEventClock(
+		&b.clock,
+		func(options ...gpiod.LineReqOption) error {
+			var err error
+			b.lines, err = gpiod.RequestLines(b.chip, pins, options...)
+			return err
+		},
+		options...,
+	)
+}
+
+// debounced reports whether any of the lines has a debounce period
+func debounced(lines []FlowLine) bool {
+	for _, line := range lines {
+		if line.DebouncePeriod() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Source returns the pulse source for the provided line offset, or nil if the
+// line is not part of the bank
+func (b *GPIOBank) Source(pin int) PulseSource {
+	source, ok := b.sources[pin]
+	if !ok {
+		return nil
+	}
+	return source
+}
+
+// Close releases the lines held by the bank. Pulse sources in the bank stop
+// receiving events
+func (b *GPIOBank) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	return b.lines.Close()
+}
+
+// dispatch passes a line event to the handler of the pulse source for that
+// line. Events on lines whose pulse source is not open are discarded
+func (b *GPIOBank) dispatch(evt gpiod.LineEvent) {
+	source, ok := b.sources[evt.Offset]
+	if !ok {
+		return
+	}
+
+	source.seqno.check(evt.LineSeqno)
+	if handler := source.handler.Load(); handler != nil {
+		(*handler)(b.clock.micro(evt.Timestamp))
+	}
+}
+
+// release closes the bank once every pulse source has been closed
+func (b *GPIOBank) release() error {
+	b.mu.Lock()
+	b.open--
+	open := b.open
+	b.mu.Unlock()
+
+	if open > 0 {
+		return nil
+	}
+	return b.Close()
+}
+
+type bankPulseSource struct {
+	bank    *GPIOBank
+	pin     int
+	handler atomic.Pointer[func(int64)]
+	seqno   seqnoCounter // only accessed by the bank's event handler
+	closed  atomic.Bool
+}
+
+func (s *bankPulseSource) Open(handler func(int64)) error {
+	if s.closed.Load() {
+		return fmt.Errorf("pin %d: pulse source closed", s.pin)
+	}
+	if !s.handler.CompareAndSwap(nil, &handler) {
+		return fmt.Errorf("pin %d: pulse source already open", s.pin)
+	}
+	return nil
+}
+
+func (s *bankPulseSource) Close() error {
+	s.handler.Store(nil)
+	if s.closed.Swap(true) {
+		return nil
+	}
+	return s.bank.release()
+}
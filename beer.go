@@ -0,0 +1,111 @@
+package kegerator
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Beer describes the beverage in a keg
+type Beer struct {
+	Name        string  `json:"name"`
+	Brewery     string  `json:"brewery,omitempty"`
+	Style       string  `json:"style,omitempty"`
+	ABV         float64 `json:"abv,omitempty"` // percent alcohol by volume
+	IBU         float64 `json:"ibu,omitempty"` // international bitterness units
+	SRM         float64 `json:"srm,omitempty"` // standard reference method color
+	Description string  `json:"description,omitempty"`
+
+	ServingTemperature float64 `json:"serving_temperature,omitempty"` // in C
+}
+
+// Validate checks that the beer is named and its measurements are in range
+func (b *Beer) Validate() error {
+	if b.Name == "" {
+		return fmt.Errorf("missing beer name")
+	}
+	if b.ABV < 0 || b.ABV > 100 {
+		return fmt.Errorf("abv %.2f out of range", b.ABV)
+	}
+	if b.IBU < 0 {
+		return fmt.Errorf("negative ibu %.2f", b.IBU)
+	}
+	if b.SRM < 0 {
+		return fmt.Errorf("negative srm %.2f", b.SRM)
+	}
+	return nil
+}
+
+// Beer returns the beer on tap, if it has been described
+func (f *Flow) Beer() *Beer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.beer
+}
+
+// SetBeer describes the beer on tap. If the beer is nil, the description is
+// removed
+func (f *Flow) SetBeer(beer *Beer) error {
+	if beer != nil {
+		err := beer.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	f.mu.Lock()
+	f.beer = beer
+	f.mu.Unlock()
+	return nil
+}
+
+// Tap is an entry in the tap list
+type Tap struct {
+	Pin       int        `json:"pin"`
+	Keg       string     `json:"keg"` // keg ID
+	Contents  string     `json:"contents"`
+	Beer      *Beer      `json:"beer,omitempty"`
+	TappedAt  *time.Time `json:"tapped_at,omitempty"`
+	Kicked    bool       `json:"kicked"`
+	Volume    float64    `json:"volume"`    // in liters
+	Remaining float64    `json:"remaining"` // in liters
+	Percent   float64    `json:"percent"`   // of volume remaining
+}
+
+// tapListEntry must be called while holding the flow's lock
+func (f *Flow) tapListEntry() Tap {
+	remaining := math.Max(f.RemainingVolume(), 0)
+	tap := Tap{
+		Pin:       f.pinNumber,
+		Keg:       f.keg.ID,
+		Contents:  f.Contents,
+		Beer:      f.beer,
+		TappedAt:  f.keg.TappedAt,
+		Kicked:    f.kicked,
+		Volume:    f.keg.Volume,
+		Remaining: remaining,
+	}
+	if f.keg.Volume > 0 {
+		tap.Percent = remaining / f.keg.Volume * 100
+	}
+	return tap
+}
+
+// TapList describes what is on each tap, ordered by pin
+func (s *State) TapList() []Tap {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	taps := make([]Tap, 0, len(s.Kegs))
+	for _, flow := range s.Kegs {
+		flow.Lock()
+		taps = append(taps, flow.tapListEntry())
+		flow.Unlock()
+	}
+	sort.Slice(taps, func(i, j int) bool {
+		return taps[i].Pin < taps[j].Pin
+	})
+	return taps
+}
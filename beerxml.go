@@ -0,0 +1,227 @@
+package kegerator
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultBeerXMLGravity = 1.050 // assumed boil gravity when a recipe has none
+
+	litersPerGallon = 3.78541
+	poundsPerKilo   = 2.20462
+)
+
+// beerXMLNumber parses numbers leniently, as display fields such as EST_OG and
+// EST_COLOR often carry units, e.g. "1.050 sg" or "6.5 SRM"
+type beerXMLNumber float64
+
+func (n *beerXMLNumber) UnmarshalText(text []byte) error {
+	fields := strings.Fields(string(text))
+	if len(fields) == 0 {
+		*n = 0
+		return nil
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSuffix(fields[0], "%"), 64)
+	if err != nil {
+		return fmt.Errorf("parse number: %w", err)
+	}
+	*n = beerXMLNumber(value)
+	return nil
+}
+
+type beerXMLRecipes struct {
+	Recipes []beerXMLRecipe `xml:"RECIPE"`
+}
+
+// beerXMLRecipe holds the fields of a BeerXML 1.0 recipe used to describe a
+// beer. Amounts are in kilograms and volumes in liters
+type beerXMLRecipe struct {
+	Name       string        `xml:"NAME"`
+	Brewer     string        `xml:"BREWER"`
+	Notes      string        `xml:"NOTES"`
+	TasteNotes string        `xml:"TASTE_NOTES"`
+	BatchSize  beerXMLNumber `xml:"BATCH_SIZE"`
+	Style      struct {
+		Name string `xml:"NAME"`
+	} `xml:"STYLE"`
+
+	OG       beerXMLNumber `xml:"OG"`
+	FG       beerXMLNumber `xml:"FG"`
+	EstOG    beerXMLNumber `xml:"EST_OG"`
+	EstFG    beerXMLNumber `xml:"EST_FG"`
+	ABV      beerXMLNumber `xml:"ABV"`
+	EstABV   beerXMLNumber `xml:"EST_ABV"`
+	IBU      beerXMLNumber `xml:"IBU"`
+	EstColor beerXMLNumber `xml:"EST_COLOR"`
+
+	Hops []struct {
+		Alpha  beerXMLNumber `xml:"ALPHA"` // percent
+		Amount beerXMLNumber `xml:"AMOUNT"`
+		Use    string        `xml:"USE"`
+		Time   beerXMLNumber `xml:"TIME"` // minutes
+	} `xml:"HOPS>HOP"`
+	Fermentables []struct {
+		Amount beerXMLNumber `xml:"AMOUNT"`
+		Color  beerXMLNumber `xml:"COLOR"` // lovibond
+	} `xml:"FERMENTABLES>FERMENTABLE"`
+}
+
+// ImportBeerXML reads a BeerXML document and describes the beer brewed by the
+// named recipe. If the document contains a single recipe, the name may be
+// omitted
+func ImportBeerXML(r io.Reader, name string) (*Beer, error) {
+	var doc beerXMLRecipes
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = beerXMLCharsetReader
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("decode beerxml: %w", err)
+	}
+	if len(doc.Recipes) == 0 {
+		return nil, fmt.Errorf("no recipes found")
+	}
+
+	if name == "" {
+		if len(doc.Recipes) > 1 {
+			return nil, fmt.Errorf("recipe name required, found %s", recipeNames(doc.Recipes))
+		}
+		return doc.Recipes[0].beer()
+	}
+
+	for _, recipe := range doc.Recipes {
+		if strings.EqualFold(strings.TrimSpace(recipe.Name), strings.TrimSpace(name)) {
+			return recipe.beer()
+		}
+	}
+	return nil, fmt.Errorf("no recipe named %q, found %s", name, recipeNames(doc.Recipes))
+}
+
+// beerXMLCharsetReader decodes latin-1, which the BeerXML specification uses
+// in its examples, to UTF-8
+func beerXMLCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "iso8859-1", "latin1", "us-ascii":
+	default:
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return strings.NewReader(string(runes)), nil
+}
+
+func recipeNames(recipes []beerXMLRecipe) string {
+	names := make([]string, len(recipes))
+	for i, recipe := range recipes {
+		names[i] = strconv.Quote(recipe.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// beer describes the beer brewed by the recipe. Measured gravities are
+// preferred over estimates, and bitterness and color are calculated from the
+// ingredients if the recipe does not include them
+func (r beerXMLRecipe) beer() (*Beer, error) {
+	beer := &Beer{
+		Name:        strings.TrimSpace(r.Name),
+		Brewery:     strings.TrimSpace(r.Brewer),
+		Style:       strings.TrimSpace(r.Style.Name),
+		Description: strings.TrimSpace(r.TasteNotes),
+		ABV:         round(r.abv(), 1),
+		IBU:         round(r.ibu(), 0),
+		SRM:         round(r.srm(), 1),
+	}
+	if beer.Description == "" {
+		beer.Description = strings.TrimSpace(r.Notes)
+	}
+
+	err := beer.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("recipe %q: %w", r.Name, err)
+	}
+	return beer, nil
+}
+
+// gravities returns the original and final gravity, preferring measured values
+func (r beerXMLRecipe) gravities() (float64, float64) {
+	og, fg := float64(r.OG), float64(r.FG)
+	if og <= 0 {
+		og = float64(r.EstOG)
+	}
+	if fg <= 0 {
+		fg = float64(r.EstFG)
+	}
+	return og, fg
+}
+
+func (r beerXMLRecipe) abv() float64 {
+	og, fg := r.gravities()
+	if og > 0 && fg > 0 && og > fg {
+		return (og - fg) * 131.25
+	}
+	if r.ABV > 0 {
+		return float64(r.ABV)
+	}
+	return float64(r.EstABV)
+}
+
+// ibu uses the Tinseth formula if the recipe does not include bitterness.
+// Only hops added to the boil contribute
+func (r beerXMLRecipe) ibu() float64 {
+	if r.IBU > 0 || r.BatchSize <= 0 {
+		return float64(r.IBU)
+	}
+
+	og, _ := r.gravities()
+	if og <= 0 {
+		og = defaultBeerXMLGravity
+	}
+	bigness := 1.65 * math.Pow(0.000125, og-1)
+
+	var ibu float64
+	for _, hop := range r.Hops {
+		use := strings.ToLower(hop.Use)
+		if use != "boil" && use != "first wort" && use != "aroma" {
+			continue
+		}
+		utilization := bigness * (1 - math.Exp(-0.04*float64(hop.Time))) / 4.15
+		concentration := float64(hop.Alpha) / 100 * float64(hop.Amount) * 1e6 / float64(r.BatchSize) // mg/L
+		ibu += utilization * concentration
+	}
+	return ibu
+}
+
+// srm uses the Morey formula if the recipe does not include color
+func (r beerXMLRecipe) srm() float64 {
+	if r.EstColor > 0 || r.BatchSize <= 0 {
+		return float64(r.EstColor)
+	}
+
+	var mcu float64
+	for _, fermentable := range r.Fermentables {
+		mcu += float64(fermentable.Color) * float64(fermentable.Amount) * poundsPerKilo
+	}
+	mcu /= float64(r.BatchSize) / litersPerGallon
+	if mcu <= 0 {
+		return 0
+	}
+	return 1.4922 * math.Pow(mcu, 0.6859)
+}
+
+// round rounds to the provided number of decimal places
+func round(value float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(value*scale) / scale
+}
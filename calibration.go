@@ -0,0 +1,152 @@
+package kegerator
+
+import (
+	"fmt"
+	"time"
+)
+
+// Calibration methods recorded with calibration results
+const (
+	CalibrationMethodSession = "session"
+	CalibrationMethodKick    = "kick"
+	CalibrationMethodManual  = "manual"
+)
+
+// CalibrationSession counts flow meter pulses while a known volume is poured
+type CalibrationSession struct {
+	StartTime time.Time `json:"start_time"`
+	Pulses    int       `json:"pulses"`
+	Estimated float64   `json:"estimated"` // volume measured by the flow meter, in liters
+}
+
+// CalibrationRecord describes the result of a calibration session
+type CalibrationRecord struct {
+	Method           string    `json:"method,omitempty"`
+	Time             time.Time `json:"time"`
+	Pulses           int       `json:"pulses"`
+	Estimated        float64   `json:"estimated"` // volume measured by the flow meter, in liters
+	Measured         float64   `json:"measured"`  // volume measured by the user, in liters
+	Error            float64   `json:"error"`     // (estimated - measured) / measured
+	PreviousConstant float64   `json:"previous_constant"`
+	FlowConstant     float64   `json:"flow_constant"`
+}
+
+// StartCalibration begins counting pulses for a calibration session. Only one
+// session may be in progress at a time
+func (f *Flow) StartCalibration() (CalibrationSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.calibration != nil {
+		return CalibrationSession{}, fmt.Errorf("calibration already in progress")
+	}
+
+	f.calibration = &CalibrationSession{
+		StartTime: f.clock.Now(),
+	}
+	f.publish(CalibrationStarted{
+		Pin:     f.pinNumber,
+		Session: *f.calibration,
+	})
+	return *f.calibration, nil
+}
+
+// Calibration returns the calibration session in progress, if any
+func (f *Flow) Calibration() (CalibrationSession, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.calibration == nil {
+		return CalibrationSession{}, false
+	}
+	return *f.calibration, true
+}
+
+// calibrate counts a pulse of the pour at idx towards the calibration session
+// in progress, if any. It must be called while holding the flow's lock
+func (f *Flow) calibrate(idx int, volume float64) {
+	if f.calibration == nil {
+		return
+	}
+	f.calibration.Pulses += 1
+	f.calibration.Estimated += volume
+
+	pour := &f.Pours[idx]
+	if pour.calibration != f.calibration {
+		pour.calibration = f.calibration
+		pour.calibrated, pour.calibratedVolume = 0, 0
+	}
+	pour.calibrated += 1
+	pour.calibratedVolume += volume
+}
+
+// CancelCalibration ends the calibration session in progress without changing
+// the flow constant
+func (f *Flow) CancelCalibration() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.calibration == nil {
+		return fmt.Errorf("no calibration in progress")
+	}
+	f.calibration = nil
+	f.publish(CalibrationCancelled{
+		Time: f.clock.Now(),
+		Pin:  f.pinNumber,
+	})
+	return nil
+}
+
+// FinishCalibration ends the calibration session in progress, given the volume
+// in liters that was actually poured during the session
+//
+// The flow constant is set such that the pulses counted would have measured
+// the poured volume exactly. If the flow meter has a calibration curve, each of
+// its points is scaled by the same ratio. The result is appended to the flow
+// meter's calibration history
+func (f *Flow) FinishCalibration(measured float64) (CalibrationRecord, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	session := f.calibration
+	if session == nil {
+		return CalibrationRecord{}, fmt.Errorf("no calibration in progress")
+	}
+	if measured <= 0 {
+		return CalibrationRecord{}, fmt.Errorf("non-positive measured volume %.4f", measured)
+	}
+	if session.Pulses == 0 {
+		return CalibrationRecord{}, fmt.Errorf("no pulses counted")
+	}
+
+	record := CalibrationRecord{
+		Method:           CalibrationMethodSession,
+		Time:             f.clock.Now(),
+		Pulses:           session.Pulses,
+		Estimated:        session.Estimated,
+		Measured:         measured,
+		Error:            (session.Estimated - measured) / measured,
+		PreviousConstant: f.sensor.FlowConstant,
+		FlowConstant:     float64(session.Pulses) / (measured * 60.0),
+	}
+
+	f.applyCalibration(record, measured/session.Estimated)
+	f.calibration = nil
+
+	return record, nil
+}
+
+// applyCalibration sets the record's flow constant, scales the flow meter's
+// calibration curve by ratio and appends the record to the flow meter's
+// calibration history. It must be called while holding the flow's lock
+func (f *Flow) applyCalibration(record CalibrationRecord, ratio float64) {
+	for i := range f.sensor.Calibration {
+		f.sensor.Calibration[i].Volume *= ratio
+	}
+	f.setFlowConstant(record.FlowConstant)
+	f.sensor.CalibrationHistory = append(f.sensor.CalibrationHistory, record)
+	f.publish(Calibrated{
+		Pin:    f.pinNumber,
+		Record: record,
+	})
+}
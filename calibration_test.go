@@ -0,0 +1,45 @@
+package kegerator
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCalibrationDiscardedPours(t *testing.T) {
+	flow, clock, _ := newTestFlow(t)
+
+	// a pour that started before the session only counts its later pulses,
+	// and neither counts once the pour is discarded
+	pour(flow, clock, 3, 50*time.Millisecond)
+	_, err := flow.StartCalibration()
+	if err != nil {
+		t.Fatalf("start calibration: %s", err)
+	}
+	clock.Advance(50 * time.Millisecond)
+	pour(flow, clock, defaultPourEventThreshold-4, 50*time.Millisecond)
+
+	session, _ := flow.Calibration()
+	if session.Pulses != defaultPourEventThreshold-4 {
+		t.Errorf("pulses during pour = %d, want %d", session.Pulses, defaultPourEventThreshold-4)
+	}
+
+	clock.Advance(defaultDeltaThreshold)
+	session, _ = flow.Calibration()
+	if session.Pulses != 0 || math.Abs(session.Estimated) > 1e-9 {
+		t.Errorf("session after discarded pour = %+v, want nothing counted", session)
+	}
+
+	// pours that are kept count in full
+	clock.Advance(time.Minute)
+	pour(flow, clock, 2*defaultPourEventThreshold, 50*time.Millisecond)
+	clock.Advance(defaultDeltaThreshold)
+
+	session, _ = flow.Calibration()
+	flow.Lock()
+	poured := flow.Pours[len(flow.Pours)-1].poured
+	flow.Unlock()
+	if session.Pulses != 2*defaultPourEventThreshold || session.Estimated != poured {
+		t.Errorf("session = %+v, want %d pulses and %f liters", session, 2*defaultPourEventThreshold, poured)
+	}
+}
@@ -0,0 +1,240 @@
+package kegerator
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current time, timers and tickers. Flows and DHT sensors
+// use a Clock rather than the time package directly so that time can be
+// controlled when replaying or testing
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer calls a function once after a duration has elapsed
+type Timer interface {
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+// Ticker delivers ticks on a channel at regular intervals
+type Ticker interface {
+	Chan() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// SystemClock uses the time package
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) Chan() <-chan time.Time {
+	return t.C
+}
+
+// ManualClock is a virtual clock that only moves when it is advanced
+//
+// Timer functions and ticks that fall due while advancing are run in deadline
+// order, with the clock set to each deadline as it is reached. Timer functions
+// are called synchronously, so the clock must not be advanced while holding a
+// lock that those functions acquire
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+// NewManualClock initializes a virtual clock set to now
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{
+		now: now,
+	}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &manualTimer{
+		clock:    c,
+		fn:       f,
+		deadline: c.now.Add(d),
+		active:   true,
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *ManualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	t := &manualTimer{
+		clock:    c,
+		deadline: c.now.Add(d),
+		period:   d,
+		active:   true,
+	}
+	t.fn = func() {
+		// drop ticks for slow receivers, as time.Ticker does
+		select {
+		case ch <- c.Now():
+		default:
+		}
+	}
+	c.timers = append(c.timers, t)
+	return &manualTicker{
+		timer: t,
+		ch:    ch,
+	}
+}
+
+// Advance moves the clock forward by d
+func (c *ManualClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock forward to t. The clock never moves backward
+func (c *ManualClock) Set(t time.Time) {
+	for {
+		c.mu.Lock()
+		next := c.next(t)
+		if next == nil {
+			if t.After(c.now) {
+				c.now = t
+			}
+			c.mu.Unlock()
+			return
+		}
+
+		if next.deadline.After(c.now) {
+			c.now = next.deadline
+		}
+		if next.period > 0 {
+			next.deadline = next.deadline.Add(next.period)
+		} else {
+			next.active = false
+		}
+		fn := next.fn
+		c.mu.Unlock()
+
+		fn()
+	}
+}
+
+// next returns the active timer with the earliest deadline no later than t,
+// removing inactive timers as it goes
+func (c *ManualClock) next(t time.Time) *manualTimer {
+	var next *manualTimer
+	active := c.timers[:0]
+	for _, timer := range c.timers {
+		if !timer.active {
+			continue
+		}
+		active = append(active, timer)
+
+		if timer.deadline.After(t) {
+			continue
+		}
+		if next == nil || timer.deadline.Before(next.deadline) {
+			next = timer
+		}
+	}
+	c.timers = active
+	return next
+}
+
+// queued reports whether the timer has not yet been removed from the clock
+func (c *ManualClock) queued(t *manualTimer) bool {
+	for _, timer := range c.timers {
+		if timer == t {
+			return true
+		}
+	}
+	return false
+}
+
+type manualTimer struct {
+	clock    *ManualClock
+	fn       func()
+	deadline time.Time
+	period   time.Duration
+	active   bool
+}
+
+func (t *manualTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	wasActive := t.active
+	t.deadline = t.clock.now.Add(d)
+	t.active = true
+	if !wasActive && !t.clock.queued(t) {
+		t.clock.timers = append(t.clock.timers, t)
+	}
+	return wasActive
+}
+
+func (t *manualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+type manualTicker struct {
+	timer *manualTimer
+	ch    chan time.Time
+}
+
+func (t *manualTicker) Chan() <-chan time.Time {
+	return t.ch
+}
+
+func (t *manualTicker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("non-positive interval for Ticker.Reset")
+	}
+
+	t.timer.clock.mu.Lock()
+	t.timer.period = d
+	t.timer.clock.mu.Unlock()
+	t.timer.Reset(d)
+}
+
+func (t *manualTicker) Stop() {
+	t.timer.Stop()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	keg "github.com/subtlepseudonym/kegerator"
+)
+
+const (
+	defaultAddr    = "http://localhost:9220"
+	defaultPin     = -1
+	defaultTimeout = 10 * time.Second
+)
+
+var (
+	Version string = "0.0.1-unknown"
+)
+
+func main() {
+	vFlag := flag.Bool("version", false, "Display version information")
+	addr := flag.String("addr", defaultAddr, "Address of the kegerator daemon")
+	pin := flag.Int("pin", defaultPin, "Pin of the keg to refill")
+	recipe := flag.String("recipe", "", "Name of the recipe to use, required if the document contains more than one")
+	printBeer := flag.Bool("print", false, "Print the beer described by the recipe rather than refilling")
+	contents := flag.String("contents", "", "Keg contents, defaulting to the recipe name")
+	kegType := flag.String("keg", "", "Type of the keg replacing the tapped keg")
+	kegID := flag.String("id", "", "ID of the keg replacing the tapped keg")
+	volume := flag.Float64("volume", 0, "Volume, in liters, of the keg replacing the tapped keg")
+	remaining := flag.Float64("remaining", 0, "Volume, in liters, remaining in a partly-full keg")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] beerxml-file\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *vFlag {
+		fmt.Println("beerxml", Version)
+		return
+	}
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var data []byte
+	var err error
+	if flag.Arg(0) == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(flag.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERR: read beerxml:", err)
+		os.Exit(1)
+	}
+
+	// parse locally first so that problems with the document are reported
+	// before anything is refilled
+	beer, err := keg.ImportBeerXML(bytes.NewReader(data), *recipe)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERR:", err)
+		os.Exit(1)
+	}
+
+	if *printBeer {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(beer)
+		return
+	}
+
+	if *pin < 0 {
+		fmt.Fprintln(os.Stderr, "ERR: pin required")
+		os.Exit(2)
+	}
+
+	query := url.Values{}
+	query.Set("pin", strconv.Itoa(*pin))
+	query.Set("recipe", beer.Name)
+	for param, value := range map[string]string{"contents": *contents, "keg": *kegType, "id": *kegID} {
+		if value != "" {
+			query.Set(param, value)
+		}
+	}
+	for param, value := range map[string]float64{"volume": *volume, "remaining": *remaining} {
+		if value > 0 {
+			query.Set(param, strconv.FormatFloat(value, 'f', -1, 64))
+		}
+	}
+
+	client := &http.Client{Timeout: defaultTimeout}
+	res, err := client.Post(*addr+"/refill/beerxml?"+query.Encode(), "application/xml", bytes.NewReader(data))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERR: refill:", err)
+		os.Exit(1)
+	}
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "ERR: refill: %s: %s\n", res.Status, bytes.TrimSpace(body))
+		os.Exit(1)
+	}
+	fmt.Printf("Refilled %d with %s\n", *pin, beer.Name)
+	os.Stdout.Write(body)
+}
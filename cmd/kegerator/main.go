@@ -5,14 +5,18 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	keg "github.com/subtlepseudonym/kegerator"
 	"github.com/subtlepseudonym/kegerator/prometheus"
+	"github.com/subtlepseudonym/kegerator/simulate"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -27,13 +31,43 @@ var (
 	Version string = "0.0.1-unknown"
 
 	noAutosave bool // prevent automatic saving of state to file
+	flowBank   bool // request all flow meter lines at once
+	simulated  bool // use simulated sensors rather than gpio
 	stateFile  string
+	traceDir   string // directory to record raw flow meter pulses to
+
+	pourLogDir    string // directory to record finished pours to
+	pourLogSize   int64
+	pourRetention time.Duration
+
+	readingLogDir    string // directory to record DHT readings to
+	readingLogSize   int64
+	readingRetention time.Duration
+	readingInterval  time.Duration
+
+	archiveLogDir  string // directory to record archived keg totals to
+	archiveLogSize int64
+
+	socketOrigins string // comma-separated origins allowed to open websockets
 )
 
 func main() {
 	vFlag := flag.Bool("version", false, "Display version information")
 	flag.BoolVar(&noAutosave, "no-autosave", false, "Do not automatically save state")
+	flag.BoolVar(&flowBank, "flow-bank", false, "Request all flow meter lines with a single gpio request")
+	flag.BoolVar(&simulated, "simulate", false, "Use simulated flow meters and DHT sensors")
 	flag.StringVar(&stateFile, "file", "state.json", "File to load initial state from")
+	flag.StringVar(&traceDir, "trace-dir", "", "Record raw flow meter pulses to trace files in this directory")
+	flag.StringVar(&pourLogDir, "pour-log", "pours", "Record finished pours to this directory, next to the state file by default, disabled if empty")
+	flag.Int64Var(&pourLogSize, "pour-log-size", keg.DefaultPourLogSize, "Size in bytes at which the pour log is rotated")
+	flag.DurationVar(&pourRetention, "pour-retention", keg.DefaultPourRetention, "Remove logged pours older than this, or never if zero")
+	flag.StringVar(&readingLogDir, "reading-log", "readings", "Record DHT readings to this directory, next to the state file by default, disabled if empty")
+	flag.Int64Var(&readingLogSize, "reading-log-size", keg.DefaultReadingLogSize, "Size in bytes at which the reading log is rotated")
+	flag.DurationVar(&readingRetention, "reading-retention", keg.DefaultReadingRetention, "Remove logged readings older than this, or never if zero")
+	flag.DurationVar(&readingInterval, "reading-interval", keg.DefaultReadingInterval, "Minimum time between logged readings from each sensor")
+	flag.StringVar(&archiveLogDir, "archive-log", "archive", "Record the totals of refilled kegs to this directory, next to the state file by default, disabled if empty")
+	flag.Int64Var(&archiveLogSize, "archive-log-size", keg.DefaultArchiveLogSize, "Size in bytes at which the archive log is rotated")
+	flag.StringVar(&socketOrigins, "socket-origins", "", "Comma-separated origins, other than the server's own, allowed to open websocket connections")
 	flag.Parse()
 
 	if *vFlag {
@@ -41,14 +75,71 @@ func main() {
 		return
 	}
 
+	// logs are kept alongside the state file unless their directories are set,
+	// so that they are written to the same volume
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if !set["pour-log"] {
+		pourLogDir = filepath.Join(filepath.Dir(stateFile), pourLogDir)
+	}
+	if !set["reading-log"] {
+		readingLogDir = filepath.Join(filepath.Dir(stateFile), readingLogDir)
+	}
+	if !set["archive-log"] {
+		archiveLogDir = filepath.Join(filepath.Dir(stateFile), archiveLogDir)
+	}
+
+	for _, origin := range strings.Split(socketOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			keg.SocketOrigins = append(keg.SocketOrigins, origin)
+		}
+	}
+
+	var hardware keg.Hardware = keg.GPIOHardware{Bank: flowBank}
+	if simulated {
+		log.Println("using simulated sensors")
+		hardware = simulate.NewHardware(time.Now().UnixNano())
+	}
+
 	var err error
 	registry := prometheus.BuildMetrics()
-	keg.GlobalState, err = keg.LoadStateFromFile(stateFile)
+	keg.GlobalState, err = keg.LoadStateFromFile(stateFile, hardware, keg.SystemClock)
 	if err != nil {
 		log.Println("ERR:", err)
 		return
 	}
 
+	if pourLogDir != "" {
+		keg.GlobalPourLog, err = keg.NewPourLog(pourLogDir, pourLogSize, pourRetention, keg.SystemClock)
+		if err != nil {
+			log.Println("ERR:", err)
+			return
+		}
+		keg.GlobalPourLog.Start(keg.DefaultEventBus)
+	}
+
+	if readingLogDir != "" {
+		keg.GlobalReadingLog, err = keg.NewReadingLog(readingLogDir, readingLogSize, readingRetention, readingInterval, keg.SystemClock)
+		if err != nil {
+			log.Println("ERR:", err)
+			return
+		}
+		keg.GlobalReadingLog.Start(keg.DefaultEventBus)
+	}
+
+	if archiveLogDir != "" {
+		keg.GlobalArchiveLog, err = keg.NewArchiveLog(archiveLogDir, archiveLogSize, keg.SystemClock)
+		if err != nil {
+			log.Println("ERR:", err)
+			return
+		}
+	}
+
+	if traceDir != "" {
+		recordTraces(keg.GlobalState)
+	}
 	for _, keg := range keg.GlobalState.Kegs {
 		keg.Start(keg.Update)
 	}
@@ -87,11 +178,14 @@ func main() {
 				}
 
 				// load and start new state
-				s, err := keg.LoadStateFromFile(stateFile)
+				s, err := keg.LoadStateFromFile(stateFile, hardware, keg.SystemClock)
 				if err != nil {
 					log.Println("ERR:", err)
 					continue
 				}
+				if traceDir != "" {
+					recordTraces(s)
+				}
 				for _, keg := range s.Kegs {
 					keg.Start(keg.Update)
 				}
@@ -105,6 +199,7 @@ func main() {
 				// remove old keg data
 				prometheus.PourVolume.Reset()
 				prometheus.RemainingVolume.Reset()
+				prometheus.KegEmptyETA.Reset()
 				keg.GlobalState = s
 				oldState.Unlock()
 				if !noAutosave {
@@ -133,17 +228,81 @@ func main() {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", keg.MetricsHandler(promHandler))
 	mux.HandleFunc("/calibrate", keg.CalibrateHandler)
+	mux.HandleFunc("/calibrate/start", keg.CalibrationStartHandler)
+	mux.HandleFunc("/calibrate/status", keg.CalibrationStatusHandler)
+	mux.HandleFunc("/calibrate/finish", keg.CalibrationFinishHandler)
+	mux.HandleFunc("/calibrate/cancel", keg.CalibrationCancelHandler)
+	mux.HandleFunc("/calibrate/history", keg.CalibrationHistoryHandler)
+	mux.HandleFunc("/calibrate/proposal", keg.CalibrationProposalHandler)
+	mux.HandleFunc("/calibrate/apply", keg.CalibrationApplyHandler)
+	mux.HandleFunc("/kicked", keg.KickHandler)
 	mux.HandleFunc("/refill", keg.RefillHandler)
+	mux.HandleFunc("/refill/beerxml", keg.BeerXMLRefillHandler)
+	mux.HandleFunc("/archive", keg.ArchiveHandler)
+	mux.HandleFunc("/beer", keg.BeerHandler)
+	mux.HandleFunc("/taplist", keg.TapListHandler)
 	mux.HandleFunc("/pours", keg.PourHandler)
+	mux.HandleFunc("/pours/detection", keg.PourDetectionHandler)
+	mux.HandleFunc("/pours/stream", keg.PourStreamHandler)
+	mux.HandleFunc("/kegs", keg.KegHandler)
+	mux.HandleFunc("/kegs/", keg.KegHandler)
+	mux.HandleFunc("/readings", keg.ReadingHandler)
 	mux.HandleFunc("/state", keg.StateHandler)
+	mux.HandleFunc("/socket", keg.SocketHandler)
 	mux.HandleFunc("/ok", keg.OKHandler)
 
+	// streaming requests don't end on their own, so they're cancelled before
+	// shutting down
+	ctx, cancel := context.WithCancel(context.Background())
 	srv := &http.Server{
-		Addr:    defaultAddr,
-		Handler: mux,
+		Addr:        defaultAddr,
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
 	log.Println("listening on", srv.Addr)
 	go srv.ListenAndServe()
 	<-stop
+	cancel()
 	srv.Shutdown(context.Background())
+
+	if keg.GlobalPourLog != nil {
+		err = keg.GlobalPourLog.Close()
+		if err != nil {
+			log.Println("ERR: close pour log:", err)
+		}
+	}
+	if keg.GlobalReadingLog != nil {
+		err = keg.GlobalReadingLog.Close()
+		if err != nil {
+			log.Println("ERR: close reading log:", err)
+		}
+	}
+	if keg.GlobalArchiveLog != nil {
+		err = keg.GlobalArchiveLog.Close()
+		if err != nil {
+			log.Println("ERR: close archive log:", err)
+		}
+	}
+}
+
+// recordTraces begins recording pulses from each keg's flow meter to a new
+// trace file in the trace directory
+func recordTraces(state *keg.State) {
+	now := time.Now().Format("20060102T150405")
+	for _, flow := range state.Kegs {
+		filename := filepath.Join(traceDir, fmt.Sprintf("pin%d_%s.trace", flow.Pin(), now))
+		f, err := os.Create(filename)
+		if err != nil {
+			log.Println("ERR: create trace file:", err)
+			continue
+		}
+
+		trace, err := keg.NewTraceWriter(f, flow.Pin(), flow.Sensor())
+		if err != nil {
+			f.Close()
+			log.Println("ERR:", err)
+			continue
+		}
+		flow.Record(trace)
+	}
 }
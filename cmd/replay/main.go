@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	keg "github.com/subtlepseudonym/kegerator"
+	"github.com/subtlepseudonym/kegerator/prometheus"
+)
+
+const (
+	defaultSpeed        = 0
+	defaultFlowConstant = 0
+	defaultSettleTime   = time.Minute // allow short pours to be pruned
+)
+
+var (
+	Version string = "0.0.1-unknown"
+)
+
+func main() {
+	vFlag := flag.Bool("version", false, "Display version information")
+	speed := flag.Float64("speed", defaultSpeed, "Playback speed relative to the recording. Values of zero or less replay as quickly as possible")
+	flowConstant := flag.Float64("flow-constant", defaultFlowConstant, "Override the flow constant recorded in the trace header")
+	maxFlowRate := flag.Float64("max-flow-rate", 0, "Maximum plausible flow rate, in L/min, used to reject glitches. Defaults to the rated maximum of the recorded meter model")
+	debounce := flag.Duration("debounce", 0, "Minimum interval between pulses, used to reject glitches")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] trace-file...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *vFlag {
+		fmt.Println("replay", Version)
+		return
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	prometheus.BuildMetrics()
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, filename := range flag.Args() {
+		trace, err := readTrace(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERR:", err)
+			os.Exit(1)
+		}
+
+		sensor := trace.Sensor
+		if *flowConstant > 0 {
+			sensor.FlowConstant = *flowConstant
+		}
+		sensor.MaxFlowRate = *maxFlowRate
+		if sensor.FlowConstant <= 0 {
+			fmt.Fprintf(os.Stderr, "ERR: %s: flow constant required\n", filename)
+			os.Exit(1)
+		}
+
+		if len(trace.Events) == 0 {
+			fmt.Fprintf(os.Stderr, "%s: no events\n", filename)
+			continue
+		}
+
+		clock := keg.NewManualClock(time.UnixMicro(trace.Events[0]))
+		flow := keg.NewFlow(&sensor, &keg.KegHalf, filepath.Base(filename), clock)
+		// events are passed to Update directly, the source only identifies the pin
+		err = flow.AttachSource(trace.Pin, keg.NewMemoryPulseSource())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERR:", err)
+			os.Exit(1)
+		}
+		flow.SetDebounce(*debounce)
+		keg.Replay(trace.Events, *speed, clock, func(event int64) {
+			if flow.Filter(event) {
+				flow.Update(event)
+			}
+		}, nil)
+		clock.Advance(defaultSettleTime)
+
+		flow.Lock()
+		for _, pour := range flow.Pours {
+			encoder.Encode(pour)
+		}
+		fmt.Fprintf(
+			os.Stderr,
+			"%s: %d events, %d pours, %.4fL\n",
+			filename,
+			len(trace.Events),
+			len(flow.Pours),
+			flow.TotalFlow(),
+		)
+		flow.Unlock()
+	}
+}
+
+func readTrace(filename string) (*keg.Trace, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("open trace file: %w", err)
+	}
+	defer f.Close()
+
+	trace, err := keg.ReadTrace(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return trace, nil
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"time"
 
 	keg "github.com/subtlepseudonym/kegerator"
@@ -30,6 +32,7 @@ func main() {
 	flowPin := flag.Int("flow", defaultPin, "Flow meter pin to test. If this flag is provided with --dht, only the flow meter will be tested")
 	flowModel := flag.String("flow-model", defaultFlowMeterModel, "Flow meter model name")
 	flowConstant := flag.Float64("flow-constant", defaultFlowConstant, "Flow meter flow constant")
+	calibrate := flag.Bool("calibrate", false, "Calibrate the flow meter by pouring a known volume")
 	dhtPin := flag.Int("dht", defaultPin, "DHT pin to test. If this flag is provided with --flow, only the flow meter will be tested")
 	dhtModel := flag.String("dht-model", defaultDHTModel, "DHT model name")
 	flag.Parse()
@@ -50,13 +53,18 @@ func main() {
 			Model:        *flowModel,
 			FlowConstant: *flowConstant,
 		}
-		flow := keg.NewFlow(sensor, &keg.KegHalf, "test")
+		flow := keg.NewFlow(sensor, &keg.KegHalf, "test", keg.SystemClock)
 
-		err := flow.Attach(uint8(*flowPin))
+		err := flow.Attach(*flowPin)
 		if err != nil {
 			fmt.Println("flow attach:", err)
 			return
 		}
+
+		if *calibrate {
+			calibrateFlow(flow, quit)
+			return
+		}
 		flow.Start(flow.Count)
 
 		for {
@@ -67,9 +75,9 @@ func main() {
 				flow.Unlock()
 			case <-quit:
 				flow.Stop()
+				return
 			}
 		}
-		return
 	}
 
 	if *dhtPin > -1 {
@@ -79,7 +87,7 @@ func main() {
 			return
 		}
 
-		dht := keg.NewDHT(model, 10*time.Second)
+		dht := keg.NewDHT(model, 10*time.Second, keg.SystemClock)
 		err = dht.Attach(*dhtPin)
 		if err != nil {
 			fmt.Println("dht attach:", err)
@@ -100,3 +108,58 @@ func main() {
 		return
 	}
 }
+
+// calibrateFlow counts pulses while the user pours into a measuring vessel,
+// then calculates the flow constant from the volume entered by the user
+func calibrateFlow(flow *keg.Flow, quit chan os.Signal) {
+	defer flow.Stop()
+
+	_, err := flow.StartCalibration()
+	if err != nil {
+		fmt.Println("calibrate:", err)
+		return
+	}
+	flow.Start(flow.Update)
+	fmt.Println("Pour into a measuring vessel, then enter the volume poured in liters:")
+
+	input := make(chan string)
+	go func() {
+		var line string
+		fmt.Scanln(&line)
+		input <- line
+	}()
+
+	for {
+		select {
+		case <-time.After(time.Second):
+			session, _ := flow.Calibration()
+			fmt.Printf("\rpulses: %d, estimated: %.4fL ", session.Pulses, session.Estimated)
+		case line := <-input:
+			fmt.Println()
+			measured, err := strconv.ParseFloat(strings.TrimSpace(line), 64)
+			if err != nil {
+				fmt.Println("parse volume:", err)
+				return
+			}
+
+			record, err := flow.FinishCalibration(measured)
+			if err != nil {
+				fmt.Println("calibrate:", err)
+				return
+			}
+			fmt.Printf(
+				"pulses: %d\nestimated: %.4fL\nmeasured: %.4fL\nerror: %.2f%%\nflow constant: %.2f -> %.2f\n",
+				record.Pulses,
+				record.Estimated,
+				record.Measured,
+				record.Error*100,
+				record.PreviousConstant,
+				record.FlowConstant,
+			)
+			return
+		case <-quit:
+			flow.CancelCalibration()
+			return
+		}
+	}
+}
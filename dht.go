@@ -38,10 +38,42 @@ func GetDHTModel(name string) (dht.SensorType, error) {
 	return dht.SensorType(0), fmt.Errorf("unknown model: %s", name)
 }
 
+// DHTReader reads temperature, in celsius, and relative humidity, in percent,
+// from a DHT sensor, also returning the number of retries that were required
+type DHTReader interface {
+	Read(ctx context.Context, retries int) (float32, float32, int, error)
+}
+
+// GPIODHTReader reads from a DHT sensor attached to a gpio pin
+type GPIODHTReader struct {
+	model dht.SensorType
+	pin   int
+}
+
+func NewGPIODHTReader(model dht.SensorType, pin int) *GPIODHTReader {
+	return &GPIODHTReader{
+		model: model,
+		pin:   pin,
+	}
+}
+
+func (r *GPIODHTReader) Read(ctx context.Context, retries int) (float32, float32, int, error) {
+	return dht.ReadDHTxxWithContextAndRetry(
+		ctx,
+		r.model,
+		r.pin,
+		false,
+		retries,
+	)
+}
+
 type DHT struct {
 	model  dht.SensorType
+	reader DHTReader
 	pin    int
-	ticker *time.Ticker
+	clock  Clock
+	ticker Ticker
+	bus    *EventBus
 	mu     sync.Mutex
 	stop   chan struct{}
 
@@ -50,18 +82,27 @@ type DHT struct {
 	Retries     int
 }
 
-func NewDHT(sensor dht.SensorType, interval time.Duration) *DHT {
+// NewDHT initializes a DHT sensor that is read on each tick of the provided
+// clock's interval
+func NewDHT(sensor dht.SensorType, interval time.Duration, clock Clock) *DHT {
 	return &DHT{
 		model:  sensor,
-		ticker: time.NewTicker(interval),
+		clock:  clock,
+		ticker: clock.NewTicker(interval),
+		bus:    DefaultEventBus,
 	}
 }
 
+// Attach reads from a DHT sensor on the specified gpio pin
 func (d *DHT) Attach(pin int) error {
-	temperature, humidity, retries, err := dht.ReadDHTxxWithRetry(
-		d.model,
-		pin,
-		false,
+	return d.AttachReader(pin, NewGPIODHTReader(d.model, pin))
+}
+
+// AttachReader takes an initial reading from the provided reader and uses it
+// for all subsequent updates. The pin number is used to identify the sensor
+func (d *DHT) AttachReader(pin int, reader DHTReader) error {
+	temperature, humidity, retries, err := reader.Read(
+		context.Background(),
 		defaultDHTAttachRetries,
 	)
 	if err != nil {
@@ -69,6 +110,7 @@ func (d *DHT) Attach(pin int) error {
 	}
 
 	d.pin = pin
+	d.reader = reader
 	d.Humidity = humidity
 	d.Retries = retries
 	prometheus.DHTHumidity.WithLabelValues(strconv.Itoa(d.pin), d.Model()).Set(float64(humidity / 100.0))
@@ -97,7 +139,7 @@ func (d *DHT) Start(update func(context.Context)) {
 	go func() {
 		for {
 			select {
-			case <-d.ticker.C:
+			case <-d.ticker.Chan():
 				update(ctx)
 			case <-d.stop:
 				cancel()
@@ -108,13 +150,7 @@ func (d *DHT) Start(update func(context.Context)) {
 }
 
 func (d *DHT) Update(ctx context.Context) {
-	temp, humid, retries, err := dht.ReadDHTxxWithContextAndRetry(
-		ctx,
-		d.model,
-		d.pin,
-		false,
-		defaultDHTReadRetries,
-	)
+	temp, humid, retries, err := d.reader.Read(ctx, defaultDHTReadRetries)
 	if err != nil {
 		log.Println("ERR:", err)
 		return
@@ -138,6 +174,23 @@ func (d *DHT) Update(ctx context.Context) {
 	prometheus.DHTTemperature.WithLabelValues(strconv.Itoa(d.pin), d.Model()).Set(float64(temp))
 	prometheus.DHTHumidity.WithLabelValues(strconv.Itoa(d.pin), d.Model()).Set(float64(humid / 100.0))
 	prometheus.DHTRetries.WithLabelValues(strconv.Itoa(d.pin), d.Model()).Add(float64(retries))
+
+	if d.bus != nil {
+		d.bus.Publish(DHTReading{
+			Time:        d.clock.Now(),
+			Pin:         d.pin,
+			Model:       d.Model(),
+			Temperature: temp,
+			Humidity:    humid,
+		})
+	}
+	d.mu.Unlock()
+}
+
+// SetEventBus changes the bus that readings are published to
+func (d *DHT) SetEventBus(bus *EventBus) {
+	d.mu.Lock()
+	d.bus = bus
 	d.mu.Unlock()
 }
 
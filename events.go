@@ -0,0 +1,228 @@
+package kegerator
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultEventBuffer    = 64                     // events buffered for each subscriber
+	defaultProgressPeriod = 250 * time.Millisecond // minimum time between pour progress events
+)
+
+// DefaultEventBus receives events from every flow that has not been given
+// another bus. It outlives the flows themselves, so subscriptions persist
+// across state reloads
+var DefaultEventBus = NewEventBus()
+
+// Event types published to an EventBus
+const (
+	EventPourStarted          = "pour_started"
+	EventPourProgress         = "pour_progress"
+	EventPourFinished         = "pour_finished"
+	EventPourDiscarded        = "pour_discarded"
+	EventKegRefilled          = "keg_refilled"
+	EventKegTapped            = "keg_tapped"
+	EventKegKicked            = "keg_kicked"
+	EventCalibrationStarted   = "calibration_started"
+	EventCalibrationCancelled = "calibration_cancelled"
+	EventCalibrated           = "calibrated"
+	EventDHTReading           = "dht_reading"
+)
+
+// Event is published to an EventBus when the state of a keg changes or a
+// sensor is read
+type Event interface {
+	EventType() string
+}
+
+// PourEvent describes the pour that an event refers to
+type PourEvent struct {
+	Pin      int    `json:"pin"`
+	Contents string `json:"contents"`
+	Pour     Pour   `json:"pour"`
+}
+
+// PourStarted is published on the first pulse of a pour. The pour may yet be
+// discarded if it does not exceed the event threshold
+type PourStarted struct{ PourEvent }
+
+// PourProgress is published once a pour exceeds the event threshold and then
+// periodically until it finishes
+type PourProgress struct {
+	PourEvent
+	Rate float64 `json:"rate"` // L/min since the previous progress event
+}
+
+// PourFinished is published once no pulses have been seen for the delta
+// threshold after a pour exceeded the event threshold
+type PourFinished struct{ PourEvent }
+
+// PourDiscarded is published when a pour is pruned for not exceeding the
+// event threshold
+type PourDiscarded struct{ PourEvent }
+
+// KegRefilled is published when a keg is refilled
+type KegRefilled struct {
+	Time     time.Time `json:"time"`
+	Pin      int       `json:"pin"`
+	Keg      string    `json:"keg"` // keg ID
+	Contents string    `json:"contents"`
+}
+
+// KegTapped is published when a keg is moved onto a flow meter
+type KegTapped struct {
+	Time     time.Time `json:"time"`
+	Pin      int       `json:"pin"`
+	Keg      string    `json:"keg"` // keg ID
+	Contents string    `json:"contents"`
+}
+
+// KegKicked is published when a keg is kicked, with the flow constant proposed
+// from the pulses counted since refill, if any
+type KegKicked struct {
+	Time     time.Time     `json:"time"`
+	Pin      int           `json:"pin"`
+	Proposal *KickProposal `json:"proposal,omitempty"`
+}
+
+// CalibrationStarted is published when a calibration session begins
+type CalibrationStarted struct {
+	Pin     int                `json:"pin"`
+	Session CalibrationSession `json:"session"`
+}
+
+// CalibrationCancelled is published when a calibration session is abandoned
+type CalibrationCancelled struct {
+	Time time.Time `json:"time"`
+	Pin  int       `json:"pin"`
+}
+
+// Calibrated is published when a flow meter's flow constant changes
+type Calibrated struct {
+	Pin    int               `json:"pin"`
+	Record CalibrationRecord `json:"record"`
+}
+
+// DHTReading is published each time a DHT sensor is read successfully
+type DHTReading struct {
+	Time        time.Time `json:"time"`
+	Pin         int       `json:"pin"`
+	Model       string    `json:"model"`
+	Temperature float32   `json:"temperature"`
+	Humidity    float32   `json:"humidity"`
+}
+
+func (PourStarted) EventType() string          { return EventPourStarted }
+func (PourProgress) EventType() string         { return EventPourProgress }
+func (PourFinished) EventType() string         { return EventPourFinished }
+func (PourDiscarded) EventType() string        { return EventPourDiscarded }
+func (KegRefilled) EventType() string          { return EventKegRefilled }
+func (KegTapped) EventType() string            { return EventKegTapped }
+func (KegKicked) EventType() string            { return EventKegKicked }
+func (CalibrationStarted) EventType() string   { return EventCalibrationStarted }
+func (CalibrationCancelled) EventType() string { return EventCalibrationCancelled }
+func (Calibrated) EventType() string           { return EventCalibrated }
+func (DHTReading) EventType() string           { return EventDHTReading }
+
+// EventBus delivers published events to every subscription. Publishing never
+// blocks: events are dropped for subscribers whose buffer is full
+type EventBus struct {
+	mu            sync.Mutex
+	subscriptions map[*Subscription]struct{}
+}
+
+// NewEventBus initializes an EventBus without subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscriptions: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe returns a subscription that receives every subsequent event. If
+// buffer is not positive, the default buffer size is used
+func (b *EventBus) Subscribe(buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = defaultEventBuffer
+	}
+
+	sub := &Subscription{
+		bus:    b,
+		events: make(chan Event, buffer),
+	}
+
+	b.mu.Lock()
+	b.subscriptions[sub] = struct{}{}
+	b.mu.Unlock()
+
+	return sub
+}
+
+// Publish delivers an event to every subscription
+func (b *EventBus) Publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscriptions {
+		select {
+		case sub.events <- event:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Subscription receives events published to an EventBus
+type Subscription struct {
+	bus     *EventBus
+	events  chan Event
+	dropped atomic.Int64
+}
+
+// Events returns the channel that events are delivered on. The channel is
+// closed when the subscription is closed
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns the number of events not delivered because the
+// subscription's buffer was full
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Close stops delivery of events to the subscription
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	if _, ok := s.bus.subscriptions[s]; !ok {
+		return
+	}
+	delete(s.bus.subscriptions, s)
+	close(s.events)
+}
+
+// SetEventBus changes the bus that the flow publishes events to
+func (f *Flow) SetEventBus(bus *EventBus) {
+	f.mu.Lock()
+	f.bus = bus
+	f.mu.Unlock()
+}
+
+// publish must be called while holding the flow's lock
+func (f *Flow) publish(event Event) {
+	if f.bus != nil {
+		f.bus.Publish(event)
+	}
+}
+
+// pourEvent must be called while holding the flow's lock
+func (f *Flow) pourEvent(pour Pour) PourEvent {
+	return PourEvent{
+		Pin:      f.pinNumber,
+		Contents: f.Contents,
+		Pour:     pour,
+	}
+}
@@ -0,0 +1,38 @@
+package kegerator
+
+import (
+	"testing"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	slow := bus.Subscribe(1)
+	fast := bus.Subscribe(4)
+
+	// publishing never blocks, so events beyond a subscription's buffer are
+	// dropped for that subscription alone
+	for i := 0; i < 3; i++ {
+		bus.Publish(PourStarted{PourEvent{Pin: i}})
+	}
+	if slow.Dropped() != 2 || fast.Dropped() != 0 {
+		t.Errorf("dropped = (%d, %d), want (2, 0)", slow.Dropped(), fast.Dropped())
+	}
+	if event := <-slow.Events(); event.(PourStarted).Pin != 0 {
+		t.Errorf("slow event = %+v, want the first event", event)
+	}
+
+	fast.Close()
+	fast.Close()
+	bus.Publish(PourStarted{PourEvent{Pin: 3}})
+
+	var pins []int
+	for event := range fast.Events() {
+		pins = append(pins, event.(PourStarted).Pin)
+	}
+	if len(pins) != 3 || pins[2] != 2 {
+		t.Errorf("fast events = %v, want [0 1 2]", pins)
+	}
+	if event := <-slow.Events(); event.(PourStarted).Pin != 3 {
+		t.Errorf("slow event = %+v, want the event published after close", event)
+	}
+}
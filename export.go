@@ -0,0 +1,320 @@
+package kegerator
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats that pours and readings may be exported in
+const (
+	FormatJSON   = "json"
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+var formatContentTypes = map[string]string{
+	FormatJSON:   "application/json",
+	FormatCSV:    "text/csv",
+	FormatNDJSON: "application/x-ndjson",
+}
+
+// exportFormat returns the format requested by the format query param or,
+// failing that, by the Accept header. JSON is used by default
+func exportFormat(r *http.Request) (string, error) {
+	if format := r.FormValue("format"); format != "" {
+		if _, ok := formatContentTypes[format]; !ok {
+			return "", fmt.Errorf("unknown format %q", format)
+		}
+		return format, nil
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(strings.TrimSpace(accept), ";")
+		switch mediaType {
+		case "text/csv":
+			return FormatCSV, nil
+		case "application/x-ndjson", "application/ndjson":
+			return FormatNDJSON, nil
+		case "application/json":
+			return FormatJSON, nil
+		}
+	}
+	return FormatJSON, nil
+}
+
+// setExportHeaders sets the content type for a format. Exports other than JSON
+// are marked as attachments named for the resource
+func setExportHeaders(w http.ResponseWriter, format, name string) {
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	if format != FormatJSON {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, name, format))
+	}
+}
+
+// pourRecord is the flattened form of a pour used by exports
+type pourRecord struct {
+	Time     string  `json:"time"`
+	Pin      int     `json:"pin"`
+	Keg      string  `json:"keg"`
+	Contents string  `json:"contents"`
+	Duration float64 `json:"duration"` // in seconds
+	Volume   float64 `json:"volume"`   // in liters
+}
+
+func newPourRecord(pour PourEvent) pourRecord {
+	return pourRecord{
+		Time:     pour.Pour.StartTime.Format(time.RFC3339),
+		Pin:      pour.Pin,
+		Keg:      pour.Pour.keg,
+		Contents: pour.Contents,
+		Duration: pour.Pour.Duration.Seconds(),
+		Volume:   pour.Pour.Volume,
+	}
+}
+
+func (p pourRecord) csv() []string {
+	return []string{
+		p.Time,
+		strconv.Itoa(p.Pin),
+		p.Keg,
+		p.Contents,
+		strconv.FormatFloat(p.Duration, 'f', -1, 64),
+		strconv.FormatFloat(p.Volume, 'f', -1, 64),
+	}
+}
+
+var pourCSVHeader = []string{"time", "pin", "keg", "contents", "duration", "volume"}
+
+// pourExporter writes pours one at a time as CSV or newline-delimited JSON,
+// so that exports need not be held in memory
+type pourExporter struct {
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+// newPourExporter writes the CSV header, if the format is CSV
+func newPourExporter(w http.ResponseWriter, format string) (*pourExporter, error) {
+	switch format {
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		return &pourExporter{csv: writer}, writer.Write(pourCSVHeader)
+	case FormatNDJSON:
+		return &pourExporter{json: json.NewEncoder(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+func (e *pourExporter) write(pour PourEvent) error {
+	record := newPourRecord(pour)
+	if e.json != nil {
+		return e.json.Encode(record)
+	}
+	return e.csv.Write(record.csv())
+}
+
+func (e *pourExporter) flush() error {
+	if e.csv == nil {
+		return nil
+	}
+	e.csv.Flush()
+	return e.csv.Error()
+}
+
+// writePourExport writes pours as CSV or newline-delimited JSON
+func writePourExport(w http.ResponseWriter, format string, pours []PourEvent) error {
+	exporter, err := newPourExporter(w, format)
+	for i := 0; err == nil && i < len(pours); i++ {
+		err = exporter.write(pours[i])
+	}
+	if err != nil {
+		return err
+	}
+	return exporter.flush()
+}
+
+// exportPours writes every pour matching the query as the pour log is read,
+// followed by the pours still in progress. Pours are written in the order that
+// they finished, rather than sorted, so that the log need not be held in
+// memory
+func exportPours(w http.ResponseWriter, query PourQuery, format string) {
+	var after *pourKey
+	if query.Cursor != "" {
+		key, err := decodePourCursor(query.Cursor)
+		if err != nil {
+			// the query was checked when it was parsed
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("ERR: query pours: %s\n", err)
+			return
+		}
+		after = &key
+	}
+	descending := query.Order == OrderDescending
+	include := func(pour PourEvent) bool {
+		return query.Match(pour) && (after == nil || after.before(keyOf(pour), descending))
+	}
+
+	// pours in progress are read before the log, so that a pour finishing in
+	// the meantime is skipped in the log rather than missed
+	var inProgress []PourEvent
+	started := make(map[pourKey]bool)
+	GlobalState.mu.Lock()
+	for _, keg := range GlobalState.Kegs {
+		keg.Lock()
+		for _, pour := range keg.Pours {
+			event := keg.pourEvent(pour)
+			if !pour.finished && include(event) {
+				inProgress = append(inProgress, event)
+				started[keyOf(event)] = true
+			}
+		}
+		keg.Unlock()
+	}
+	GlobalState.mu.Unlock()
+
+	// the response has begun by the time that the log fails, if it does, so
+	// errors can only be logged
+	setExportHeaders(w, format, "pours")
+	exporter, err := newPourExporter(w, format)
+	if err == nil {
+		err = GlobalPourLog.Each(query, func(pour PourEvent) error {
+			if started[keyOf(pour)] || !include(pour) {
+				return nil
+			}
+			return exporter.write(pour)
+		})
+	}
+	for i := 0; err == nil && i < len(inProgress); i++ {
+		err = exporter.write(inProgress[i])
+	}
+	if err == nil {
+		err = exporter.flush()
+	}
+	if err != nil {
+		log.Printf("ERR: export pours: %s\n", err)
+	}
+}
+
+var readingCSVHeader = []string{"time", "pin", "model", "temperature", "humidity"}
+
+// readingExporter writes readings one at a time as CSV or newline-delimited
+// JSON, so that exports need not be held in memory
+type readingExporter struct {
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+// newReadingExporter writes the CSV header, if the format is CSV
+func newReadingExporter(w http.ResponseWriter, format string) (*readingExporter, error) {
+	switch format {
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		return &readingExporter{csv: writer}, writer.Write(readingCSVHeader)
+	case FormatNDJSON:
+		return &readingExporter{json: json.NewEncoder(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+func (e *readingExporter) write(reading DHTReading) error {
+	if e.json != nil {
+		return e.json.Encode(reading)
+	}
+	return e.csv.Write([]string{
+		reading.Time.Format(time.RFC3339Nano),
+		strconv.Itoa(reading.Pin),
+		reading.Model,
+		strconv.FormatFloat(float64(reading.Temperature), 'f', -1, 32),
+		strconv.FormatFloat(float64(reading.Humidity), 'f', -1, 32),
+	})
+}
+
+func (e *readingExporter) flush() error {
+	if e.csv == nil {
+		return nil
+	}
+	e.csv.Flush()
+	return e.csv.Error()
+}
+
+// ReadingHandler lists logged DHT readings matching the query params, oldest
+// first, in the format selected by the format query param or Accept header.
+// JSON lists the most recent readings up to the limit. Exports include every
+// matching reading unless a limit is set, and are written as the log is read
+func ReadingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if GlobalReadingLog == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "reading log disabled"}`))
+		return
+	}
+
+	format, err := exportFormat(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+	query, err := ParseReadingQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+
+	if format != FormatJSON && r.URL.Query().Get("limit") == "" {
+		// the response has begun by the time that the log fails, if it does,
+		// so errors can only be logged
+		setExportHeaders(w, format, "readings")
+		exporter, err := newReadingExporter(w, format)
+		if err == nil {
+			err = GlobalReadingLog.Each(query, exporter.write)
+		}
+		if err == nil {
+			err = exporter.flush()
+		}
+		if err != nil {
+			log.Printf("ERR: export readings: %s\n", err)
+		}
+		return
+	}
+
+	readings, err := GlobalReadingLog.Query(query)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("ERR: read reading log: %s\n", err)
+		return
+	}
+
+	setExportHeaders(w, format, "readings")
+	if format != FormatJSON {
+		exporter, err := newReadingExporter(w, format)
+		for i := 0; err == nil && i < len(readings); i++ {
+			err = exporter.write(readings[i])
+		}
+		if err == nil {
+			err = exporter.flush()
+		}
+		if err != nil {
+			log.Printf("write readings: %s", err)
+		}
+		return
+	}
+
+	if readings == nil {
+		readings = []DHTReading{}
+	}
+	err = json.NewEncoder(w).Encode(readings)
+	if err != nil {
+		log.Printf("write readings: %s", err)
+	}
+}
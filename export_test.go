@@ -0,0 +1,125 @@
+package kegerator
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportFormat(t *testing.T) {
+	tests := []struct {
+		target string
+		accept string
+		format string
+	}{
+		{"/pours", "", FormatJSON},
+		{"/pours?format=csv", "application/json", FormatCSV},
+		{"/pours", "text/html, text/csv;q=0.9", FormatCSV},
+		{"/pours", "application/x-ndjson", FormatNDJSON},
+		{"/pours", "*/*", FormatJSON},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.target, nil)
+		r.Header.Set("Accept", test.accept)
+		format, err := exportFormat(r)
+		if err != nil || format != test.format {
+			t.Errorf("%s with %q = (%q, %v), want %q", test.target, test.accept, format, err, test.format)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/pours?format=xml", nil)
+	if _, err := exportFormat(r); err == nil {
+		t.Errorf("unknown format: expected error")
+	}
+}
+
+func TestWritePourExport(t *testing.T) {
+	pours := testPours(3)
+
+	w := httptest.NewRecorder()
+	err := writePourExport(w, FormatCSV, pours)
+	if err != nil {
+		t.Fatalf("csv: %s", err)
+	}
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("read csv: %s", err)
+	}
+	if len(rows) != len(pours)+1 || strings.Join(rows[0], ",") != strings.Join(pourCSVHeader, ",") {
+		t.Fatalf("rows = %v, want header and %d pours", rows, len(pours))
+	}
+	if rows[2][1] != "27" || rows[2][3] != "stout" || rows[2][5] != "0.2" {
+		t.Errorf("row = %v, want second pour", rows[2])
+	}
+
+	w = httptest.NewRecorder()
+	err = writePourExport(w, FormatNDJSON, pours)
+	if err != nil {
+		t.Fatalf("ndjson: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != len(pours) {
+		t.Fatalf("lines = %d, want %d", len(lines), len(pours))
+	}
+	var record pourRecord
+	err = json.Unmarshal([]byte(lines[0]), &record)
+	if err != nil || record.Pin != 17 || record.Contents != "ipa" {
+		t.Errorf("record = %+v (%v), want first pour", record, err)
+	}
+}
+
+func TestExportPours(t *testing.T) {
+	flow, clock, _ := newTestFlow(t)
+	l, err := NewPourLog(t.TempDir(), 1<<20, 0, clock)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer l.Close()
+
+	logged := testPours(4)
+	for _, pour := range logged {
+		err = l.Append(pour)
+		if err != nil {
+			t.Fatalf("append: %s", err)
+		}
+	}
+
+	// a pour in progress that is also logged has finished since it was read
+	// from memory, so it is only written once
+	clock.Set(testStart.Add(10 * time.Minute))
+	pour(flow, clock, defaultPourEventThreshold, 50*time.Millisecond)
+	flow.Lock()
+	inProgress := flow.pourEvent(flow.Pours[0])
+	flow.Unlock()
+	err = l.Append(inProgress)
+	if err != nil {
+		t.Fatalf("append: %s", err)
+	}
+
+	previousState, previousLog := GlobalState, GlobalPourLog
+	GlobalState, GlobalPourLog = &State{Kegs: []*Flow{flow}}, l
+	defer func() { GlobalState, GlobalPourLog = previousState, previousLog }()
+
+	w := httptest.NewRecorder()
+	exportPours(w, PourQuery{Order: OrderDescending}, FormatCSV)
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("read csv: %s", err)
+	}
+	if len(rows) != len(logged)+2 {
+		t.Fatalf("rows = %v, want header, %d logged pours and the pour in progress", rows, len(logged))
+	}
+	// logged pours are written in the order they were logged
+	for i, pour := range logged {
+		if rows[i+1][0] != pour.Pour.StartTime.Format(time.RFC3339) {
+			t.Errorf("row %d = %v, want pour at %s", i+1, rows[i+1], pour.Pour.StartTime.Format(time.RFC3339))
+		}
+	}
+	if last := rows[len(rows)-1]; last[0] != inProgress.Pour.StartTime.Format(time.RFC3339) || last[1] != "17" {
+		t.Errorf("last row = %v, want pour in progress", last)
+	}
+}
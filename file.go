@@ -6,6 +6,7 @@ import (
 	"math"
 	"os"
 	"sync"
+	"time"
 )
 
 // GlobalState holds all the keg and sensor state
@@ -19,12 +20,20 @@ var GlobalState *State
 // and is used for both saving state to file and writing state to a REST
 // endpoint
 type State struct {
-	mu   sync.Mutex `json:"-"`
-	Kegs []*Flow    `json:"-"`
-	DHTs []*DHT     `json:"-"`
+	mu    sync.Mutex `json:"-"`
+	clock Clock      // used for kegs that are not tapped
+	Kegs  []*Flow    `json:"-"`
+	DHTs  []*DHT     `json:"-"`
 
 	KegOut []kegOutput `json:"kegs"`
 	DHTOut []dhtOutput `json:"dhts"`
+
+	// Cellar holds kegs that are not tapped, so that they keep their history
+	// while moving between taps
+	Cellar []StoredKeg `json:"cellar,omitempty"`
+
+	// Archive records the totals of kegs as they were refilled or replaced
+	Archive []KegArchive `json:"archive,omitempty"`
 }
 
 func (s *State) Lock() {
@@ -35,21 +44,32 @@ func (s *State) Unlock() {
 	s.mu.Unlock()
 }
 
+// now returns the current time from the state's clock
+func (s *State) now() time.Time {
+	if s.clock == nil {
+		return SystemClock.Now()
+	}
+	return s.clock.Now()
+}
+
+// detach releases the sensors held by kegs and DHTs that have been attached
+func (s *State) detach() {
+	for _, keg := range s.Kegs {
+		keg.Detach()
+	}
+	for _, dht := range s.DHTs {
+		dht.Detach()
+	}
+}
+
 // Update ensures that the exported state fields represent the state's
 // internal representation
 func (s *State) update() {
 	kegOutputs := make([]kegOutput, len(s.Kegs))
 	for i, keg := range s.Kegs {
 		keg.Lock()
-		out := kegOutput{
-			Keg:      keg.keg,
-			Contents: keg.Contents,
-			Sensor:   keg.Sensor(),
-			Pin:      keg.Pin(),
-			Poured:   keg.TotalFlow(),
-		}
+		kegOutputs[i] = keg.output()
 		keg.Unlock()
-		kegOutputs[i] = out
 	}
 
 	dhtOutputs := make([]dhtOutput, len(s.DHTs))
@@ -70,11 +90,55 @@ func (s *State) update() {
 }
 
 type kegOutput struct {
-	Keg      *Keg       `json:"keg"`
-	Sensor   *FlowMeter `json:"sensor"`
-	Contents string     `json:"contents"`
-	Pin      int        `json:"pin"`
-	Poured   float64    `json:"poured"`
+	Keg      *Keg        `json:"keg"`
+	Sensor   *FlowMeter  `json:"sensor"`
+	Contents string      `json:"contents"`
+	Beer     *Beer       `json:"beer,omitempty"`
+	Pin      int         `json:"pin"`
+	Line     *LineConfig `json:"line,omitempty"`
+	Poured   float64     `json:"poured"`
+
+	Detection *PourDetection `json:"pour_detection,omitempty"`
+
+	// PouredByConstant takes precedence over Poured when loading state, as
+	// it records the flow constant that measured each volume
+	PouredByConstant []PouredVolume `json:"poured_by_constant,omitempty"`
+	Pulses           int            `json:"pulses,omitempty"`         // since refill, estimated from volume if unset
+	PartialPulses    bool           `json:"partial_pulses,omitempty"` // the keg was poured from before pulses were counted
+	Kicked           bool           `json:"kicked,omitempty"`
+	AutoCalibrate    bool           `json:"auto_calibrate,omitempty"`
+
+	Forecast *Forecast `json:"forecast,omitempty"` // ignored when loading state
+}
+
+// output describes the flow's keg for the state file and API. It must be
+// called while holding the flow's lock
+func (f *Flow) output() kegOutput {
+	tapped := *f.keg
+	out := kegOutput{
+		Keg:      &tapped,
+		Contents: f.Contents,
+		Beer:     f.beer,
+		Sensor:   f.Sensor(),
+		Pin:      f.Pin(),
+		Poured:   f.TotalFlow(),
+
+		PouredByConstant: f.Dispensed(),
+		Pulses:           f.pulseTotal,
+		PartialPulses:    f.partial,
+		Kicked:           f.kicked,
+		AutoCalibrate:    f.autoCalibrate,
+		Forecast:         f.forecast(),
+	}
+	if f.deltaThreshold != defaultDeltaThreshold || f.eventThreshold != defaultPourEventThreshold {
+		detection := f.pourDetection()
+		out.Detection = &detection
+	}
+	if f.line != (LineConfig{}) {
+		line := f.line
+		out.Line = &line
+	}
+	return out
 }
 
 type dhtOutput struct {
@@ -84,8 +148,13 @@ type dhtOutput struct {
 	Humidity    float32 `json:"humidity,omitempty"`
 }
 
-func LoadStateFromFile(filename string) (*State, error) {
-	var state State
+// LoadStateFromFile reads state from the provided file and attaches each keg
+// and DHT sensor to the sensor interfaces provided by hw. Kegs, DHT sensors and
+// the state itself keep time with clock
+func LoadStateFromFile(filename string, hw Hardware, clock Clock) (*State, error) {
+	state := State{
+		clock: clock,
+	}
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, fmt.Errorf("open state file: %w", err)
@@ -97,12 +166,139 @@ func LoadStateFromFile(filename string) (*State, error) {
 		return nil, fmt.Errorf("decode state file: %w", err)
 	}
 
-	for _, keg := range state.KegOut {
-		flow := NewFlow(keg.Sensor, keg.Keg, keg.Contents)
-		flow.eventTotal = int(math.Ceil(keg.Poured / flow.flowPerEvent))
-		err = flow.Attach(uint8(keg.Pin % math.MaxUint8))
+	ids := make(map[string]bool)
+	lines := make([]FlowLine, len(state.KegOut))
+	for i, keg := range state.KegOut {
+		line := FlowLine{
+			Pin:    keg.Pin,
+			Sensor: keg.Sensor,
+		}
+		if keg.Line != nil {
+			line.LineConfig = *keg.Line
+		}
+
+		if keg.Sensor == nil {
+			return nil, fmt.Errorf("missing sensor for pin %d", keg.Pin)
+		}
+		err = keg.Sensor.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid sensor for pin %d: %w", keg.Pin, err)
+		}
+		if keg.Keg == nil {
+			return nil, fmt.Errorf("missing keg for pin %d", keg.Pin)
+		}
+		err = keg.Keg.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid keg for pin %d: %w", keg.Pin, err)
+		}
+		if keg.Keg.ID == "" {
+			// pours were identified by pin and contents before kegs had IDs
+			keg.Keg.ID = fmt.Sprintf("%d_%s", keg.Pin, keg.Contents)
+		}
+		if ids[keg.Keg.ID] {
+			return nil, fmt.Errorf("duplicate keg id %q", keg.Keg.ID)
+		}
+		ids[keg.Keg.ID] = true
+		if keg.Keg.State == "" {
+			keg.Keg.State = KegStateTapped
+			if keg.Kicked {
+				keg.Keg.State = KegStateKicked
+			} else if keg.Poured > 0 || len(keg.PouredByConstant) > 0 {
+				keg.Keg.State = KegStateServing
+			}
+		}
+		if keg.Beer != nil {
+			err = keg.Beer.Validate()
+			if err != nil {
+				return nil, fmt.Errorf("invalid beer for pin %d: %w", keg.Pin, err)
+			}
+		}
+		for _, poured := range keg.PouredByConstant {
+			if poured.FlowConstant <= 0 || poured.Volume < 0 {
+				return nil, fmt.Errorf("invalid poured volume for pin %d: %+v", keg.Pin, poured)
+			}
+		}
+		if keg.Detection != nil {
+			err = keg.Detection.Validate()
+			if err != nil {
+				return nil, fmt.Errorf("invalid pour detection for pin %d: %w", keg.Pin, err)
+			}
+		}
+		if line.Pin < 0 {
+			return nil, fmt.Errorf("invalid pin %d", keg.Pin)
+		}
+		err = line.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid line for pin %d: %w", keg.Pin, err)
+		}
+		lines[i] = line
+	}
+	for _, stored := range state.Cellar {
+		if stored.Keg == nil {
+			return nil, fmt.Errorf("missing keg in cellar")
+		}
+		err = stored.Keg.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid keg %q in cellar: %w", stored.Keg.ID, err)
+		}
+		if stored.Keg.ID == "" {
+			stored.Keg.ID = newKegID()
+		}
+		if ids[stored.Keg.ID] {
+			return nil, fmt.Errorf("duplicate keg id %q", stored.Keg.ID)
+		}
+		ids[stored.Keg.ID] = true
+		if stored.Keg.State == "" {
+			stored.Keg.State = KegStateFilled
+		}
+		if stored.Beer != nil {
+			err = stored.Beer.Validate()
+			if err != nil {
+				return nil, fmt.Errorf("invalid beer for keg %q: %w", stored.Keg.ID, err)
+			}
+		}
+		for _, poured := range stored.Poured {
+			if poured.FlowConstant <= 0 || poured.Volume < 0 {
+				return nil, fmt.Errorf("invalid poured volume for keg %q: %+v", stored.Keg.ID, poured)
+			}
+		}
+	}
+
+	sources, err := hw.PulseSources(lines)
+	if err != nil {
+		return nil, fmt.Errorf("open pulse sources: %w", err)
+	}
+
+	for i, keg := range state.KegOut {
+		flow := NewFlow(keg.Sensor, keg.Keg, keg.Contents, clock)
+		if len(keg.PouredByConstant) > 0 {
+			flow.SetDispensed(keg.PouredByConstant)
+		} else {
+			flow.SetDispensed([]PouredVolume{{FlowConstant: keg.Sensor.FlowConstant, Volume: keg.Poured}})
+		}
+		flow.pulseTotal = keg.Pulses
+		if flow.pulseTotal == 0 {
+			for _, poured := range flow.dispensed {
+				flow.pulseTotal += int(math.Round(poured.Volume * poured.FlowConstant * 60.0))
+			}
+		}
+		flow.beer = keg.Beer
+		flow.partial = keg.PartialPulses
+		flow.kicked = keg.Kicked
+		flow.autoCalibrate = keg.AutoCalibrate
+		flow.line = lines[i].LineConfig
+		flow.SetDebounce(lines[i].DebouncePeriod())
+		if keg.Detection != nil {
+			flow.SetPourDetection(*keg.Detection)
+		}
+		err = flow.AttachSource(lines[i].Pin, sources[i])
 		if err != nil {
-			return nil, fmt.Errorf("attach flow on pin %d: %s", keg.Pin, err)
+			// release sources that will not be attached
+			for _, source := range sources[i:] {
+				source.Close()
+			}
+			state.detach()
+			return nil, fmt.Errorf("attach flow on pin %d: %s", lines[i].Pin, err)
 		}
 		state.Kegs = append(state.Kegs, flow)
 	}
@@ -110,12 +306,14 @@ func LoadStateFromFile(filename string) (*State, error) {
 	for _, dht := range state.DHTOut {
 		dhtModel, ok := dhtModels[dht.Model]
 		if !ok {
+			state.detach()
 			return nil, fmt.Errorf("invalid dht model %q", dht.Model)
 		}
 
-		dhtSensor := NewDHT(dhtModel, defaultDHTReadInterval)
-		err = dhtSensor.Attach(dht.Pin)
+		dhtSensor := NewDHT(dhtModel, defaultDHTReadInterval, clock)
+		err = dhtSensor.AttachReader(dht.Pin, hw.DHTReader(dht.Pin, dhtModel))
 		if err != nil {
+			state.detach()
 			return nil, fmt.Errorf("attach dht on pin %d: %s", dht.Pin, err)
 		}
 		state.DHTs = append(state.DHTs, dhtSensor)
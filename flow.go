@@ -4,143 +4,519 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/subtlepseudonym/kegerator/prometheus"
-
-	"github.com/warthog618/gpiod"
 )
 
 const (
 	defaultGPIOChip           = "gpiochip0" // gpio chip device name
 	defaultDeltaThreshold     = time.Second // used to separate pour events
 	defaultPourEventThreshold = 10          // number of flow events to exceed to constitute a pour
+	defaultPulseBufferSize    = 1024        // number of pulses buffered before coalescing
+	defaultMaxFlowRate        = 10.0        // liters per minute, for meters of unknown models
+	maxFlowRateHeadroom       = 1.5         // allowance for jitter in the interval between pulses
+	defaultPourMemory         = 100         // finished pours kept in memory once logged
 )
 
 type FlowMeter struct {
 	Model        string  `json:"model"`
-	FlowConstant float64 `json:"flow_constant"` // in 1/60L
+	FlowConstant float64 `json:"flow_constant"`           // in 1/60L
+	MaxFlowRate  float64 `json:"max_flow_rate,omitempty"` // in L/min, defaulting to the model's rated maximum
+
+	// Calibration optionally corrects for meters that are nonlinear across
+	// flow rates. If set, it is used in place of FlowConstant when measuring
+	// volume during a pour
+	Calibration []CalibrationPoint `json:"calibration,omitempty"`
+
+	CalibrationHistory []CalibrationRecord `json:"calibration_history,omitempty"`
+}
+
+// CalibrationPoint relates the frequency of flow meter pulses to the volume
+// dispensed by each pulse at that frequency
+type CalibrationPoint struct {
+	Frequency float64 `json:"frequency"` // in Hz
+	Volume    float64 `json:"volume"`    // in L
+}
+
+// Validate checks that the flow constant and calibration points are positive,
+// sorts calibration points by frequency and defaults the maximum flow rate to
+// the model's rated maximum
+func (m *FlowMeter) Validate() error {
+	if m.FlowConstant <= 0 {
+		return fmt.Errorf("non-positive flow constant %.2f", m.FlowConstant)
+	}
+	if m.MaxFlowRate < 0 {
+		return fmt.Errorf("negative max flow rate %.2f", m.MaxFlowRate)
+	}
+	if m.MaxFlowRate == 0 {
+		m.MaxFlowRate = ratedMaxFlowRate(m.Model)
+	}
+
+	for _, point := range m.Calibration {
+		if point.Frequency <= 0 || point.Volume <= 0 {
+			return fmt.Errorf("non-positive calibration point %+v", point)
+		}
+	}
+	sort.Slice(m.Calibration, func(i, j int) bool {
+		return m.Calibration[i].Frequency < m.Calibration[j].Frequency
+	})
+
+	return nil
+}
+
+// pulseVolume returns the volume, in liters, dispensed by a pulse arriving
+// interval after the previous pulse
+//
+// The volume is linearly interpolated between the calibration points either
+// side of the pulse frequency and is clamped to the volume of the lowest and
+// highest frequency points. Without calibration points, or without a previous
+// pulse, the volume is derived from the flow constant
+func (m *FlowMeter) pulseVolume(interval time.Duration) float64 {
+	points := m.Calibration
+	if len(points) == 0 || interval <= 0 {
+		return 1.0 / (m.FlowConstant * 60.0)
+	}
+
+	frequency := float64(time.Second) / float64(interval)
+	if frequency <= points[0].Frequency {
+		return points[0].Volume
+	}
+	if frequency >= points[len(points)-1].Frequency {
+		return points[len(points)-1].Volume
+	}
+
+	i := sort.Search(len(points), func(i int) bool {
+		return points[i].Frequency >= frequency
+	})
+	low, high := points[i-1], points[i]
+	ratio := (frequency - low.Frequency) / (high.Frequency - low.Frequency)
+	return low.Volume + ratio*(high.Volume-low.Volume)
+}
+
+// minPulseInterval returns the shortest plausible interval between pulses,
+// given the meter's maximum flow rate. Individual intervals vary about the mean,
+// so some headroom is allowed above the maximum
+//
+// F = KQ; F is pulses per second; Q is liters per minute
+func (m *FlowMeter) minPulseInterval() time.Duration {
+	maxFlowRate := m.MaxFlowRate
+	if maxFlowRate <= 0 {
+		maxFlowRate = ratedMaxFlowRate(m.Model)
+	}
+	return time.Duration(float64(time.Second) / (m.FlowConstant * maxFlowRate * maxFlowRateHeadroom))
+}
+
+// PourDetection configures how flow meter pulses are grouped into pours. Zero
+// values use the defaults
+type PourDetection struct {
+	DeltaThreshold string `json:"delta_threshold,omitempty"` // duration separating pours, e.g. 1s
+	EventThreshold int    `json:"event_threshold,omitempty"` // pulses required to constitute a pour
 }
 
-// These values are here for reference, but are not actually used
-// Actual FlowConstant values are loaded from file
+// Validate checks that the thresholds are positive, if set
+func (d PourDetection) Validate() error {
+	if d.DeltaThreshold != "" {
+		delta, err := time.ParseDuration(d.DeltaThreshold)
+		if err != nil {
+			return fmt.Errorf("parse delta threshold: %w", err)
+		}
+		if delta <= 0 {
+			return fmt.Errorf("non-positive delta threshold %s", d.DeltaThreshold)
+		}
+	}
+	if d.EventThreshold < 0 {
+		return fmt.Errorf("negative event threshold %d", d.EventThreshold)
+	}
+	return nil
+}
+
+// thresholds returns the configured thresholds, substituting defaults for
+// unset or invalid values
+func (d PourDetection) thresholds() (time.Duration, int) {
+	delta, err := time.ParseDuration(d.DeltaThreshold)
+	if err != nil || delta <= 0 {
+		delta = defaultDeltaThreshold
+	}
+	events := d.EventThreshold
+	if events <= 0 {
+		events = defaultPourEventThreshold
+	}
+	return delta, events
+}
+
+// These values are here for reference. Actual FlowConstant values are loaded
+// from file, but the rated MaxFlowRate is used for meters of the same model
+// that do not set their own
 var (
 	// digiten fl-s401a
 	FlowMeterFLS401A = FlowMeter{
 		Model:        "fl-s401a",
 		FlowConstant: 98,
+		MaxFlowRate:  10,
 	}
 	// gredia gr-r401
 	FlowMeterGRR401 = FlowMeter{
 		Model:        "gr-r401",
 		FlowConstant: 98,
+		MaxFlowRate:  10,
 	}
 	// gredia gr-301
 	FlowMeterGR301 = FlowMeter{
 		Model:        "gr-301",
 		FlowConstant: 21,
+		MaxFlowRate:  30,
 	}
 	// uxcell a18041200ux0151
 	FlowMeterUX0151 = FlowMeter{
 		Model:        "ux0151",
 		FlowConstant: 76,
+		MaxFlowRate:  6,
 	}
 )
 
+// ratedMaxFlowRate returns the rated maximum flow rate, in L/min, of the
+// reference flow meter matching model, or defaultMaxFlowRate if there is none
+func ratedMaxFlowRate(model string) float64 {
+	for _, meter := range []FlowMeter{FlowMeterFLS401A, FlowMeterGRR401, FlowMeterGR301, FlowMeterUX0151} {
+		if strings.EqualFold(meter.Model, model) {
+			return meter.MaxFlowRate
+		}
+	}
+	return defaultMaxFlowRate
+}
+
+// PouredVolume is the volume, in liters, measured while a flow constant was in
+// use
+type PouredVolume struct {
+	FlowConstant float64 `json:"flow_constant"`
+	Volume       float64 `json:"volume"`
+}
+
 type Pour struct {
-	prune  *time.Timer `json:"-"`
-	events int         `json:"-"`
-	keg    string      `json:"keg"`
+	idle     Timer   `json:"-"` // fires once the pour has ended
+	events   int     `json:"-"`
+	poured   float64 `json:"-"` // liters added to the flow's total, including the first event
+	counted  bool    `json:"-"` // whether the pour has exceeded the event threshold
+	finished bool    `json:"-"`
+
+	// duration and volume at the previous progress event
+	progressAt     time.Duration `json:"-"`
+	progressVolume float64       `json:"-"`
+	keg            string        `json:"-"` // keg ID
+
+	// pulses and volume counted by the calibration session in progress, which
+	// are removed from the session if the pour is discarded
+	calibration      *CalibrationSession `json:"-"`
+	calibrated       int                 `json:"-"`
+	calibratedVolume float64             `json:"-"`
 
 	StartTime time.Time     `json:"time"`
 	Duration  time.Duration `json:"duration"`
 	Volume    float64       `json:"volume"`
 }
 
-func (p Pour) MarshalJSON() ([]byte, error) {
-	pour := struct {
-		Time     string  `json:"time"`
-		Keg      string  `json:"keg"`
-		Duration float64 `json:"duration"`
-		Volume   float64 `json:"volume"`
-	}{
-		Time:     p.StartTime.Format(time.RFC3339),
+// pourJSON is the encoded form of a pour, with its start time in the provided
+// layout
+type pourJSON struct {
+	Time     string  `json:"time"`
+	Keg      string  `json:"keg"`
+	Duration float64 `json:"duration"`
+	Volume   float64 `json:"volume"`
+}
+
+func (p Pour) encode(layout string) pourJSON {
+	return pourJSON{
+		Time:     p.StartTime.Format(layout),
 		Keg:      p.keg,
 		Duration: p.Duration.Seconds(),
 		Volume:   p.Volume,
 	}
+}
 
-	return json.Marshal(pour)
+func (p Pour) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.encode(time.RFC3339))
+}
+
+// UnmarshalJSON accepts start times with or without fractional seconds
+func (p *Pour) UnmarshalJSON(data []byte) error {
+	var pour pourJSON
+	err := json.Unmarshal(data, &pour)
+	if err != nil {
+		return err
+	}
+
+	start, err := time.Parse(time.RFC3339, pour.Time)
+	if err != nil {
+		return fmt.Errorf("parse pour time: %w", err)
+	}
+
+	*p = Pour{
+		keg:       pour.Keg,
+		StartTime: start,
+		Duration:  time.Duration(pour.Duration * float64(time.Second)),
+		Volume:    pour.Volume,
+	}
+	return nil
 }
 
 type Flow struct {
 	keg       *Keg
 	sensor    *FlowMeter
+	clock     Clock
 	pinNumber int
-	line      *gpiod.Line
+	line      LineConfig
+	source    PulseSource
 
 	deltaThreshold time.Duration
+	eventThreshold int
 	flowPerEvent   float64 // 1 / (flowConstant * 60)
 
-	mu         sync.Mutex
-	signalChan chan int64
-	stop       chan struct{}
+	mu     sync.Mutex
+	pulses *pulseRing
+	notify chan struct{}
+	stop   chan struct{}
+	trace  atomic.Pointer[TraceWriter]
+
+	// pulses received while the buffer is full are counted rather than queued
+	coalesced      atomic.Int64
+	coalescedEvent atomic.Int64 // latest coalesced pulse
+
+	// pulses arriving sooner than minInterval after the previous accepted pulse
+	// are rejected as glitches
+	debounce    time.Duration
+	minInterval atomic.Int64 // nanoseconds
+	lastPulse   int64        // microseconds, only accessed by Filter
 
 	latestEvent int64 // microseconds
-	eventTotal  int   // scalar
+	pulseTotal  int   // pulses measured since the last refill
+	partial     bool  // the keg was poured from before pulses were counted
 	firstRun    sync.Once
+	calibration *CalibrationSession
+	bus         *EventBus
+
+	// foam indicates a kicked keg; the pulses counted since refill are then
+	// used to propose a new flow constant
+	foam          kickDetector
+	kicked        bool
+	proposal      *KickProposal
+	autoCalibrate bool
+
+	forecastDays    *pouredDays // read from the pour log, then counted as pours finish
+	forecastLoading bool        // whether the pour log is being read into forecastDays
+
+	// volume dispensed since the last refill, split by the flow constant that
+	// measured it. Changing the flow constant only affects subsequent pulses
+	dispensed []PouredVolume
+
+	beer *Beer // optional, describes the contents
 
 	Pours    []Pour
 	Contents string
 }
 
 // NewFlow initializes a Flow struct given a flow constant (defined by the flow meter)
-// and a starting volume in liters
-func NewFlow(flowMeter *FlowMeter, keg *Keg, contents string) *Flow {
+// and a starting volume in liters. Pours are pruned using timers from the provided
+// clock. The keg is copied, as its lifecycle is tracked by the flow, and is given
+// an ID if it has none
+func NewFlow(flowMeter *FlowMeter, keg *Keg, contents string, clock Clock) *Flow {
+	tapped := *keg
+	if tapped.ID == "" {
+		tapped.ID = newKegID()
+	}
+
 	meter := &Flow{
-		keg:            keg,
+		keg:            &tapped,
 		sensor:         flowMeter,
+		clock:          clock,
 		deltaThreshold: defaultDeltaThreshold,
+		eventThreshold: defaultPourEventThreshold,
+		bus:            DefaultEventBus,
 		flowPerEvent:   1.0 / (flowMeter.FlowConstant * 60.0),
-		signalChan:     make(chan int64, 1000),
+		pulses:         newPulseRing(defaultPulseBufferSize),
+		notify:         make(chan struct{}, 1),
+		dispensed:      []PouredVolume{{FlowConstant: flowMeter.FlowConstant}},
 		Contents:       contents,
 	}
+	meter.minInterval.Store(int64(flowMeter.minPulseInterval()))
 
 	return meter
 }
 
-// Attach allocates a memory range for gpio operations and opens the specified pin for
-// input and begins watching it for events
-func (f *Flow) Attach(pin uint8) error {
-	f.pinNumber = int(pin)
-	var err error
-	f.line, err = gpiod.RequestLine(
-		defaultGPIOChip,
-		f.pinNumber,
-		gpiod.WithPullUp,
-		gpiod.AsInput,
-		gpiod.WithEventHandler(func(evt gpiod.LineEvent) {
-			f.signalChan <- time.Now().UnixMicro()
-		}),
-		gpiod.WithFallingEdge,
-	)
+// Attach opens the specified pin on the default gpio chip for input and begins
+// watching it for events
+func (f *Flow) Attach(pin int) error {
+	return f.AttachSource(pin, NewGPIOPulseSource(pin, LineConfig{}))
+}
+
+// AttachSource begins watching the provided pulse source for events. The pin
+// number is used to identify the flow meter
+func (f *Flow) AttachSource(pin int, source PulseSource) error {
+	f.pinNumber = pin
+	f.source = source
+
+	err := source.Open(f.receive)
 	if err != nil {
-		return fmt.Errorf("request pin %d failed: %w", pin, err)
+		return fmt.Errorf("open pulse source: %w", err)
 	}
 
 	return nil
 }
 
-// Detach releases the memory range held by the gpio package and stops watching
-// the signal pin specified by a previous call to attach()
+// Detach closes the pulse source specified by a previous call to Attach or
+// AttachSource and stops watching it for events
 func (f *Flow) Detach() error {
-	f.line.Close()
+	if f.source == nil {
+		return nil
+	}
+	return f.source.Close()
+}
+
+// receive buffers a pulse from the pulse source for processing. It never blocks,
+// so that a slow update cannot stall the pulse source. Pulses are recorded to
+// the trace, if any, before they are filtered
+func (f *Flow) receive(event int64) {
+	if trace := f.trace.Load(); trace != nil {
+		trace.Record(event)
+	}
+
+	if !f.Filter(event) {
+		return
+	}
+
+	if !f.pulses.push(event) {
+		f.coalesced.Add(1)
+		f.coalescedEvent.Store(event)
+	}
+
+	select {
+	case f.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Filter reports whether a pulse is plausible, given the previous accepted
+// pulse. Pulses closer together than the debounce period, or than the flow
+// meter's maximum flow rate allows, are rejected and counted as a metric
+//
+// Filter must not be called concurrently, as pulse sources are expected to
+// deliver pulses serially
+func (f *Flow) Filter(event int64) bool {
+	interval := time.Duration(event-f.lastPulse) * time.Microsecond
+	if f.lastPulse != 0 && interval >= 0 && interval < time.Duration(f.minInterval.Load()) {
+		prometheus.FlowRejectedPulses.WithLabelValues(strconv.Itoa(f.pinNumber)).Inc()
+		return false
+	}
+
+	f.lastPulse = event
+	return true
+}
+
+// SetDebounce sets the minimum interval between pulses. The flow meter's
+// maximum flow rate may impose a longer interval
+func (f *Flow) SetDebounce(debounce time.Duration) {
+	f.mu.Lock()
+	f.debounce = debounce
+	f.updateMinInterval()
+	f.mu.Unlock()
+}
+
+// SetFlowConstant changes the flow meter's flow constant. Volume that has
+// already been measured is unaffected
+func (f *Flow) SetFlowConstant(constant float64) {
+	f.mu.Lock()
+	previous := f.sensor.FlowConstant
+	f.setFlowConstant(constant)
+	f.publish(Calibrated{
+		Pin: f.pinNumber,
+		Record: CalibrationRecord{
+			Method:           CalibrationMethodManual,
+			Time:             f.clock.Now(),
+			PreviousConstant: previous,
+			FlowConstant:     constant,
+		},
+	})
+	f.mu.Unlock()
+}
+
+// setFlowConstant must be called while holding the flow's lock
+func (f *Flow) setFlowConstant(constant float64) {
+	f.sensor.FlowConstant = constant
+	f.flowPerEvent = 1.0 / (constant * 60.0)
+	f.updateMinInterval()
+
+	last := &f.dispensed[len(f.dispensed)-1]
+	if last.Volume == 0 {
+		last.FlowConstant = constant
+	} else if last.FlowConstant != constant {
+		f.dispensed = append(f.dispensed, PouredVolume{FlowConstant: constant})
+	}
+}
+
+// dispense adds volume to the total measured under the current flow constant.
+// It must be called while holding the flow's lock
+func (f *Flow) dispense(volume float64) {
+	f.dispensed[len(f.dispensed)-1].Volume += volume
+}
+
+// undispense removes volume from the total measured, starting with the volume
+// measured under the current flow constant. It must be called while holding
+// the flow's lock
+func (f *Flow) undispense(volume float64) {
+	for i := len(f.dispensed) - 1; i >= 0 && volume > 0; i-- {
+		removed := math.Min(volume, f.dispensed[i].Volume)
+		f.dispensed[i].Volume -= removed
+		volume -= removed
+	}
+}
+
+// SetPourDetection changes how subsequent pulses are grouped into pours. A
+// pour in progress that has not yet exceeded the event threshold is checked
+// against the new thresholds on its next pulse
+func (f *Flow) SetPourDetection(detection PourDetection) error {
+	err := detection.Validate()
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.deltaThreshold, f.eventThreshold = detection.thresholds()
+	f.mu.Unlock()
 	return nil
 }
 
-// Start reads from the signal channel, updating metrics as each signal is processed
+// PourDetection returns the thresholds used to group pulses into pours
+func (f *Flow) PourDetection() PourDetection {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.pourDetection()
+}
+
+// pourDetection must be called while holding the flow's lock
+func (f *Flow) pourDetection() PourDetection {
+	return PourDetection{
+		DeltaThreshold: f.deltaThreshold.String(),
+		EventThreshold: f.eventThreshold,
+	}
+}
+
+// updateMinInterval must be called while holding the flow's lock
+func (f *Flow) updateMinInterval() {
+	interval := f.sensor.minPulseInterval()
+	if f.debounce > interval {
+		interval = f.debounce
+	}
+	f.minInterval.Store(int64(interval))
+}
+
+// Start reads from the pulse buffer, updating metrics as each pulse is processed
 func (f *Flow) Start(update func(int64)) {
 	if f.stop != nil {
 		return
@@ -150,8 +526,8 @@ func (f *Flow) Start(update func(int64)) {
 	go func() {
 		for {
 			select {
-			case event := <-f.signalChan:
-				update(event)
+			case <-f.notify:
+				f.drain(update)
 			case <-f.stop:
 				return
 			}
@@ -159,6 +535,39 @@ func (f *Flow) Start(update func(int64)) {
 	}()
 }
 
+// drain processes all buffered pulses
+//
+// Pulses that were coalesced while the buffer was full are processed last, at
+// the time of the latest coalesced pulse. This preserves the total volume
+// poured, at the cost of timing accuracy for those pulses
+func (f *Flow) drain(update func(int64)) {
+	var latest int64
+	for {
+		event, ok := f.pulses.pop()
+		if !ok {
+			break
+		}
+		update(event)
+		latest = event
+	}
+
+	count := f.coalesced.Swap(0)
+	if count == 0 {
+		return
+	}
+
+	event := f.coalescedEvent.Load()
+	if event < latest {
+		event = latest
+	}
+	for i := int64(0); i < count; i++ {
+		update(event)
+	}
+
+	prometheus.FlowCoalescedPulses.WithLabelValues(strconv.Itoa(f.pinNumber)).Add(float64(count))
+	log.Printf("WARN: pin %d: coalesced %d pulses\n", f.pinNumber, count)
+}
+
 // Stop stops monitoring keg liquid flow
 func (f *Flow) Stop() {
 	if f.stop == nil {
@@ -166,6 +575,22 @@ func (f *Flow) Stop() {
 	}
 	close(f.stop)
 	f.Detach()
+
+	if trace := f.trace.Swap(nil); trace != nil {
+		err := trace.Close()
+		if err != nil {
+			log.Printf("ERR: pin %d: close trace: %s\n", f.pinNumber, err)
+		}
+	}
+}
+
+// Record writes every subsequent pulse received from the pulse source to the
+// provided trace. The trace is closed when the flow is stopped
+func (f *Flow) Record(trace *TraceWriter) {
+	old := f.trace.Swap(trace)
+	if old != nil {
+		old.Close()
+	}
 }
 
 func (f *Flow) Lock() {
@@ -176,18 +601,40 @@ func (f *Flow) Unlock() {
 	f.mu.Unlock()
 }
 
-// Refill resets state with a new contents value
-func (f *Flow) Refill(contents string) {
-	f.mu.Lock()
-	f.Contents = contents
-	f.eventTotal = 0
-	f.mu.Unlock()
-}
-
 // TotalFlow is a convenience method for determining the total volume of flow, in
 // liters, that have been measured
 func (f *Flow) TotalFlow() float64 {
-	return f.flowPerEvent * float64(f.eventTotal)
+	var total float64
+	for _, dispensed := range f.dispensed {
+		total += dispensed.Volume
+	}
+	return total
+}
+
+// Dispensed returns the volume measured since the last refill, split by the
+// flow constant in use when it was measured
+func (f *Flow) Dispensed() []PouredVolume {
+	dispensed := make([]PouredVolume, len(f.dispensed))
+	copy(dispensed, f.dispensed)
+	return dispensed
+}
+
+// SetDispensed replaces the volume measured since the last refill. If the last
+// entry was measured with a different flow constant than the current one, an
+// entry for the current flow constant is added
+func (f *Flow) SetDispensed(dispensed []PouredVolume) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.setDispensed(dispensed)
+}
+
+// setDispensed must be called while holding the flow's lock
+func (f *Flow) setDispensed(dispensed []PouredVolume) {
+	f.dispensed = append([]PouredVolume{}, dispensed...)
+	if len(f.dispensed) == 0 || f.dispensed[len(f.dispensed)-1].FlowConstant != f.sensor.FlowConstant {
+		f.dispensed = append(f.dispensed, PouredVolume{FlowConstant: f.sensor.FlowConstant})
+	}
 }
 
 // RemainingVolume is a convenience method for reporting the total volume remaining
@@ -225,72 +672,162 @@ func (f *Flow) Update(event int64) {
 
 	// TODO: make atomic / thread-safe
 	f.latestEvent = event
-	f.eventTotal += 1
+	f.pulseTotal += 1
 
 	// Only update flow rate if there's an ongoing pour
-	if delta > f.deltaThreshold {
-		idx := len(f.Pours)
-		prune := time.AfterFunc(f.deltaThreshold, func() {
-			f.mu.Lock()
-			defer f.mu.Unlock()
-
-			if idx >= len(f.Pours) {
-				log.Printf("WARN: prune index %d greater than highest pour index\n", idx)
-				return
-			} else if idx < 0 {
-				log.Printf("WARN: negative prune index: %d\n", idx)
-				return
-			}
-			f.eventTotal -= f.Pours[idx].events
-			f.Pours = append(f.Pours[:idx], f.Pours[idx+1:]...)
-
-			if len(f.Pours) == 0 {
-				f.latestEvent = 0
-			} else {
-				latestPour := f.Pours[idx-1]
-				f.latestEvent = latestPour.StartTime.Add(latestPour.Duration).UnixMicro()
-			}
+	if delta > f.deltaThreshold || len(f.Pours) == 0 || f.Pours[len(f.Pours)-1].finished {
+		f.dispense(f.flowPerEvent)
+		f.foam.reset()
+
+		var idle Timer
+		idle = f.clock.AfterFunc(f.deltaThreshold, func() {
+			f.endPour(idle)
 		})
 
-		f.Pours = append(f.Pours, Pour{
-			prune:     prune,
+		pour := Pour{
+			idle:      idle,
 			events:    1,
-			keg:       fmt.Sprintf("%d_%s", f.pinNumber, f.Contents),
+			poured:    f.flowPerEvent,
+			keg:       f.keg.ID,
 			StartTime: time.UnixMicro(event),
-		})
+		}
+		f.Pours = append(f.Pours, pour)
+		f.calibrate(len(f.Pours)-1, f.flowPerEvent)
+		f.publish(PourStarted{f.pourEvent(pour)})
 		return
 	}
 
+	volume := f.sensor.pulseVolume(delta)
+	f.dispense(volume)
+	f.foam.add(delta)
+	f.detectKick()
+
 	idx := len(f.Pours) - 1
+	f.calibrate(idx, volume)
 	f.Pours[idx].events += 1
 	f.Pours[idx].Duration += delta
-	f.Pours[idx].Volume += f.flowPerEvent
+	f.Pours[idx].Volume += volume
+	f.Pours[idx].poured += volume
+	f.Pours[idx].idle.Reset(f.deltaThreshold)
 
 	pour := f.Pours[idx]
-	if pour.events < defaultPourEventThreshold {
-		pour.prune.Reset(f.deltaThreshold)
-	} else if pour.events == defaultPourEventThreshold {
-		// once pour threshold is reached, stop prune goroutine
-		pour.prune.Stop()
-
-		poured := float64(defaultPourEventThreshold) * f.flowPerEvent
+	if pour.counted {
 		prometheus.PourVolume.WithLabelValues(
 			strconv.Itoa(f.pinNumber),
 			f.keg.Type,
 			f.Contents,
-		).Add(poured)
-	} else {
+		).Add(volume)
+	} else if pour.events >= f.eventThreshold {
+		f.Pours[idx].counted = true
+		if f.keg.State == KegStateTapped {
+			f.keg.transition(KegStateServing, f.clock.Now())
+		}
+
+		// include the first event of the pour, which has no volume of its own
 		prometheus.PourVolume.WithLabelValues(
 			strconv.Itoa(f.pinNumber),
 			f.keg.Type,
 			f.Contents,
-		).Add(f.flowPerEvent)
+		).Add(pour.poured)
+	} else {
+		return
+	}
+
+	// progress is published as soon as the pour exceeds the event threshold
+	if !pour.counted || pour.Duration-pour.progressAt >= defaultProgressPeriod {
+		f.progress(idx)
+	}
+}
+
+// progress publishes the progress of a pour. It must be called while holding
+// the flow's lock
+func (f *Flow) progress(idx int) {
+	pour := &f.Pours[idx]
+
+	var rate float64
+	if elapsed := pour.Duration - pour.progressAt; elapsed > 0 {
+		rate = (pour.Volume - pour.progressVolume) / elapsed.Minutes()
+	}
+	pour.progressAt = pour.Duration
+	pour.progressVolume = pour.Volume
+
+	f.publish(PourProgress{
+		PourEvent: f.pourEvent(*pour),
+		Rate:      rate,
+	})
+}
+
+// endPour is called once no pulses have been seen for the delta threshold
+// after a pour. Pours that exceeded the event threshold are finished, while
+// the rest are pruned
+func (f *Flow) endPour(idle Timer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// locate the pour by its timer, as earlier pours may have been pruned
+	for i := len(f.Pours) - 1; i >= 0; i-- {
+		if f.Pours[i].idle != idle {
+			continue
+		}
+		// the pour may have been ended early, as its keg was untapped
+		if !f.Pours[i].finished {
+			f.closePour(i)
+		}
+		return
+	}
+}
+
+// endPours ends every pour in progress without waiting for the delta
+// threshold. It must be called while holding the flow's lock
+func (f *Flow) endPours() {
+	// closing a pour may prune others, so each search starts over
+	for i := 0; i < len(f.Pours); i++ {
+		if !f.Pours[i].finished {
+			f.Pours[i].idle.Stop()
+			f.closePour(i)
+			i = -1
+		}
+	}
+}
+
+// closePour finishes or prunes the pour at idx. It must be called while
+// holding the flow's lock
+func (f *Flow) closePour(idx int) {
+	pour := f.Pours[idx]
+	if pour.counted {
+		f.Pours[idx].finished = true
+		f.countForecast(pour)
+		f.publish(PourFinished{f.pourEvent(pour)})
+
+		// finished pours are recorded by the pour log, so only the most
+		// recent are kept. Without a log, memory is the only record of them
+		for GlobalPourLog != nil && len(f.Pours) > defaultPourMemory && f.Pours[0].finished {
+			f.Pours = f.Pours[1:]
+		}
+		return
+	}
+
+	f.undispense(pour.poured)
+	f.pulseTotal -= pour.events
+	if f.calibration != nil && pour.calibration == f.calibration {
+		f.calibration.Pulses -= pour.calibrated
+		f.calibration.Estimated -= pour.calibratedVolume
+	}
+	f.Pours = append(f.Pours[:idx], f.Pours[idx+1:]...)
+	f.publish(PourDiscarded{f.pourEvent(pour)})
+
+	if len(f.Pours) == 0 {
+		f.latestEvent = 0
+	} else if idx == len(f.Pours) {
+		latestPour := f.Pours[idx-1]
+		f.latestEvent = latestPour.StartTime.Add(latestPour.Duration).UnixMicro()
 	}
 }
 
-// Count is used for testing and updates _only_ total event count
+// Count is used for testing and updates _only_ total volume measured
 func (f *Flow) Count(event int64) {
 	f.mu.Lock()
-	f.eventTotal += 1
+	f.dispense(f.flowPerEvent)
+	f.pulseTotal += 1
 	f.mu.Unlock()
 }
@@ -0,0 +1,252 @@
+package kegerator
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/subtlepseudonym/kegerator/prometheus"
+)
+
+func TestMain(m *testing.M) {
+	prometheus.BuildMetrics()
+	os.Exit(m.Run())
+}
+
+var testStart = time.Date(2023, 4, 3, 18, 0, 0, 0, time.UTC)
+
+// newTestFlow returns a flow driven by a manual clock, publishing to its own
+// event bus
+func newTestFlow(t *testing.T) (*Flow, *ManualClock, *Subscription) {
+	t.Helper()
+
+	clock := NewManualClock(testStart)
+	meter := FlowMeterFLS401A
+	keg := KegCorny
+	flow := NewFlow(&meter, &keg, "ipa", clock)
+	err := flow.AttachSource(17, NewMemoryPulseSource())
+	if err != nil {
+		t.Fatalf("attach source: %s", err)
+	}
+
+	bus := NewEventBus()
+	flow.SetEventBus(bus)
+	sub := bus.Subscribe(4096)
+	t.Cleanup(sub.Close)
+	return flow, clock, sub
+}
+
+// pour sends pulses to the flow at the provided interval, starting at the
+// clock's current time, and returns the time of the last pulse
+func pour(flow *Flow, clock *ManualClock, pulses int, interval time.Duration) time.Time {
+	t := clock.Now()
+	for i := 0; i < pulses; i++ {
+		if i > 0 {
+			t = t.Add(interval)
+		}
+		clock.Set(t)
+		flow.Update(t.UnixMicro())
+	}
+	return t
+}
+
+// eventTypes returns the types of the events published so far
+func eventTypes(sub *Subscription) []string {
+	var types []string
+	for {
+		select {
+		case event := <-sub.Events():
+			types = append(types, event.EventType())
+		default:
+			return types
+		}
+	}
+}
+
+func TestPourSegmentation(t *testing.T) {
+	flow, clock, _ := newTestFlow(t)
+
+	// pulses closer together than the delta threshold are a single pour
+	pour(flow, clock, 20, 50*time.Millisecond)
+	clock.Advance(defaultDeltaThreshold / 2)
+	last := pour(flow, clock, 20, 50*time.Millisecond)
+
+	flow.Lock()
+	if len(flow.Pours) != 1 || flow.Pours[0].finished {
+		t.Fatalf("pours = %d, want 1 unfinished pour", len(flow.Pours))
+	}
+	flow.Unlock()
+
+	// the pour ends once no pulse is seen for the delta threshold, and a
+	// longer gap starts a new one
+	clock.Set(last.Add(2 * defaultDeltaThreshold))
+	pour(flow, clock, 20, 50*time.Millisecond)
+	clock.Advance(defaultDeltaThreshold)
+
+	flow.Lock()
+	defer flow.Unlock()
+	if len(flow.Pours) != 2 {
+		t.Fatalf("pours = %d, want 2", len(flow.Pours))
+	}
+
+	first, second := flow.Pours[0], flow.Pours[1]
+	wantDuration := 38*50*time.Millisecond + defaultDeltaThreshold/2
+	if !first.StartTime.Equal(testStart) || first.Duration != wantDuration || first.events != 40 {
+		t.Errorf("first pour = (%s, %s, %d events), want (%s, %s, 40 events)", first.StartTime, first.Duration, first.events, testStart, wantDuration)
+	}
+	if second.Duration != 19*50*time.Millisecond || second.events != 20 {
+		t.Errorf("second pour = (%s, %d events), want (%s, 20 events)", second.Duration, second.events, 19*50*time.Millisecond)
+	}
+	if !first.finished || !second.finished {
+		t.Errorf("finished = (%t, %t), want both finished", first.finished, second.finished)
+	}
+}
+
+func TestPourEventThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		detection *PourDetection
+		pulses    int
+		counted   bool
+	}{
+		{"below default", nil, defaultPourEventThreshold - 1, false},
+		{"at default", nil, defaultPourEventThreshold, true},
+		{"below custom", &PourDetection{EventThreshold: 3}, 2, false},
+		{"at custom", &PourDetection{EventThreshold: 3}, 3, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flow, clock, sub := newTestFlow(t)
+			if test.detection != nil {
+				err := flow.SetPourDetection(*test.detection)
+				if err != nil {
+					t.Fatalf("set pour detection: %s", err)
+				}
+			}
+
+			pour(flow, clock, test.pulses, 50*time.Millisecond)
+
+			// pours are only ended once the delta threshold has passed
+			clock.Advance(defaultDeltaThreshold - time.Millisecond)
+			flow.Lock()
+			if len(flow.Pours) != 1 {
+				t.Errorf("pours before threshold = %d, want 1", len(flow.Pours))
+			}
+			flow.Unlock()
+
+			clock.Advance(time.Millisecond)
+			flow.Lock()
+			defer flow.Unlock()
+			types := eventTypes(sub)
+			if len(types) == 0 || types[0] != EventPourStarted {
+				t.Fatalf("events = %v, want %s first", types, EventPourStarted)
+			}
+			last := types[len(types)-1]
+			if !test.counted {
+				// discarded pours leave no trace of their volume or pulses
+				if len(flow.Pours) != 0 || flow.TotalFlow() != 0 || flow.pulseTotal != 0 {
+					t.Errorf("pours = %d, total = %f, pulses = %d, want nothing", len(flow.Pours), flow.TotalFlow(), flow.pulseTotal)
+				}
+				if last != EventPourDiscarded {
+					t.Errorf("last event = %s, want %s", last, EventPourDiscarded)
+				}
+				return
+			}
+
+			if len(flow.Pours) != 1 || !flow.Pours[0].counted || !flow.Pours[0].finished {
+				t.Fatalf("pours = %+v, want 1 counted, finished pour", flow.Pours)
+			}
+			if flow.TotalFlow() != flow.Pours[0].poured {
+				t.Errorf("total = %f, want %f", flow.TotalFlow(), flow.Pours[0].poured)
+			}
+			if last != EventPourFinished {
+				t.Errorf("last event = %s, want %s", last, EventPourFinished)
+			}
+		})
+	}
+}
+
+func TestPourPruning(t *testing.T) {
+	for _, logged := range []bool{true, false} {
+		t.Run(fmt.Sprintf("logged=%t", logged), func(t *testing.T) {
+			flow, clock, _ := newTestFlow(t)
+
+			previous := GlobalPourLog
+			GlobalPourLog = nil
+			if logged {
+				l, err := NewPourLog(t.TempDir(), 1<<20, 0, clock)
+				if err != nil {
+					t.Fatalf("new pour log: %s", err)
+				}
+				defer l.Close()
+				GlobalPourLog = l
+			}
+			defer func() { GlobalPourLog = previous }()
+
+			pours := defaultPourMemory + 5
+			var starts []time.Time
+			for i := 0; i < pours; i++ {
+				starts = append(starts, clock.Now())
+				pour(flow, clock, defaultPourEventThreshold, 50*time.Millisecond)
+				clock.Advance(time.Minute)
+			}
+
+			flow.Lock()
+			defer flow.Unlock()
+			if flow.pulseTotal != pours*defaultPourEventThreshold {
+				t.Errorf("pulse total = %d, want %d", flow.pulseTotal, pours*defaultPourEventThreshold)
+			}
+
+			// without a log, memory is the only record of past pours
+			if !logged {
+				if len(flow.Pours) != pours {
+					t.Fatalf("pours = %d, want %d", len(flow.Pours), pours)
+				}
+				return
+			}
+
+			// the oldest pours are pruned, without losing their volume
+			if len(flow.Pours) != defaultPourMemory {
+				t.Fatalf("pours = %d, want %d", len(flow.Pours), defaultPourMemory)
+			}
+			if oldest := flow.Pours[0].StartTime; !oldest.Equal(starts[pours-defaultPourMemory]) {
+				t.Errorf("oldest pour = %s, want %s", oldest, starts[pours-defaultPourMemory])
+			}
+		})
+	}
+}
+
+func TestPourDetectionDelta(t *testing.T) {
+	flow, clock, _ := newTestFlow(t)
+	err := flow.SetPourDetection(PourDetection{DeltaThreshold: "2s"})
+	if err != nil {
+		t.Fatalf("set pour detection: %s", err)
+	}
+
+	// a gap longer than the default delta threshold, but shorter than the
+	// configured one, does not end the pour
+	last := pour(flow, clock, 20, 50*time.Millisecond)
+	clock.Set(last.Add(1500 * time.Millisecond))
+	pour(flow, clock, 20, 50*time.Millisecond)
+	clock.Advance(2 * time.Second)
+
+	flow.Lock()
+	defer flow.Unlock()
+	if len(flow.Pours) != 1 || flow.Pours[0].events != 40 {
+		t.Fatalf("pours = %d, want a single pour of 40 events", len(flow.Pours))
+	}
+}
+
+func TestPourDetectionValidate(t *testing.T) {
+	for _, detection := range []PourDetection{
+		{DeltaThreshold: "soon"},
+		{DeltaThreshold: "-1s"},
+		{EventThreshold: -1},
+	} {
+		if err := detection.Validate(); err == nil {
+			t.Errorf("%+v: expected error", detection)
+		}
+	}
+}
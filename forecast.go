@@ -0,0 +1,242 @@
+package kegerator
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	defaultForecastSmoothing = 0.3 // weight of each day's consumption against the previous estimate
+	defaultForecastHorizon   = 365 // days, beyond which kegs are not forecast to run out
+)
+
+// Forecast estimates when a keg will run out from its daily consumption.
+// Weekdays and weekends are estimated separately, as they are rarely alike
+type Forecast struct {
+	WeekdayRate float64    `json:"weekday_rate"` // liters per day
+	WeekendRate float64    `json:"weekend_rate"` // liters per day
+	Empty       *time.Time `json:"empty,omitempty"`
+}
+
+// Forecast estimates when the keg will run out, or returns nil if there is not
+// yet a full day of pours since the keg was tapped
+func (f *Flow) Forecast() *Forecast {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.forecast()
+}
+
+// forecast exponentially smooths the volume poured on each full day since the
+// keg was tapped, with days on which nothing was poured counting as zero. The
+// smoothed weekday and weekend rates are then projected forward from the
+// remaining volume. It must be called while holding the flow's lock
+func (f *Flow) forecast() *Forecast {
+	now := f.clock.Now()
+	today := startOfDay(now)
+
+	var days *pouredDays
+	if GlobalPourLog == nil {
+		days = f.memoryDays(today)
+	} else {
+		days = f.loggedDays(GlobalPourLog, today)
+		if days == nil {
+			return nil
+		}
+	}
+	if days.start.IsZero() || !days.start.Before(today) {
+		return nil
+	}
+
+	var rates [2]float64 // weekday, weekend
+	var seen [2]bool
+	for day := days.start; day.Before(today); day = day.AddDate(0, 0, 1) {
+		i := dayClass(day)
+		if !seen[i] {
+			rates[i], seen[i] = days.daily[day], true
+			continue
+		}
+		rates[i] = defaultForecastSmoothing*days.daily[day] + (1-defaultForecastSmoothing)*rates[i]
+	}
+	// until a keg has seen both weekdays and weekends, each stands in for the
+	// other
+	if !seen[0] {
+		rates[0] = rates[1]
+	}
+	if !seen[1] {
+		rates[1] = rates[0]
+	}
+
+	forecast := &Forecast{
+		WeekdayRate: rates[0],
+		WeekendRate: rates[1],
+	}
+	remaining := f.RemainingVolume()
+	if f.kicked || remaining <= 0 {
+		forecast.Empty = &now
+		return forecast
+	}
+
+	t := now
+	for i := 0; i < defaultForecastHorizon; i++ {
+		next := startOfDay(t).AddDate(0, 0, 1)
+		rate := rates[dayClass(t)]
+		days := next.Sub(t).Hours() / 24
+		if rate*days >= remaining {
+			empty := t.Add(time.Duration(remaining / rate * 24 * float64(time.Hour)))
+			forecast.Empty = &empty
+			break
+		}
+		remaining -= rate * days
+		t = next
+	}
+	return forecast
+}
+
+// pouredDays is the volume poured from a keg on each day, along with the first
+// day of the keg's consumption
+type pouredDays struct {
+	keg    string
+	tapped time.Time
+	loc    *time.Location // of the days' boundaries
+
+	daily map[time.Time]float64
+	start time.Time
+
+	// the day on which reading the pour log failed, if it did, so that it is
+	// retried at most once a day
+	failed time.Time
+}
+
+// loggedDays returns the keg's daily totals read from the pour log, or nil if
+// they are not yet known. The log is only read once for each keg that is
+// tapped, in the background so that the flow's lock is not held while reading
+// it, and the totals are then kept up to date as pours finish. It must be
+// called while holding the flow's lock
+func (f *Flow) loggedDays(pourLog *PourLog, today time.Time) *pouredDays {
+	var tapped time.Time
+	if f.keg.TappedAt != nil {
+		tapped = *f.keg.TappedAt
+	}
+
+	days := f.forecastDays
+	if days != nil && days.keg == f.keg.ID && days.tapped.Equal(tapped) {
+		if days.failed.IsZero() {
+			return days
+		}
+		if !today.After(days.failed) {
+			return nil
+		}
+	}
+
+	if !f.forecastLoading {
+		f.forecastLoading = true
+		go f.loadDays(pourLog, f.keg.ID, tapped, today.Location())
+	}
+	return nil
+}
+
+// loadDays reads the keg's pours since it was tapped from the pour log and
+// caches their daily totals for forecasting
+func (f *Flow) loadDays(pourLog *PourLog, keg string, tapped time.Time, loc *time.Location) {
+	logged, err := pourLog.match(PourQuery{
+		Keg:  keg,
+		From: tapped,
+	})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.forecastLoading = false
+
+	days := &pouredDays{
+		keg:    keg,
+		tapped: tapped,
+		loc:    loc,
+		daily:  make(map[time.Time]float64),
+	}
+	if err != nil {
+		log.Printf("ERR: pin %d: forecast: read pour log: %s\n", f.pinNumber, err)
+		days.failed = startOfDay(f.clock.Now().In(loc))
+		f.forecastDays = days
+		return
+	}
+
+	var latest time.Time
+	for _, pour := range logged {
+		days.add(pour.Pour)
+		if pour.Pour.StartTime.After(latest) {
+			latest = pour.Pour.StartTime
+		}
+	}
+	// pours are logged as they finish, so those that finished while the log
+	// was read may not have been written yet
+	for _, pour := range f.Pours {
+		if pour.finished && pour.keg == keg && pour.StartTime.After(latest) && !pour.StartTime.Before(tapped) {
+			days.add(pour)
+		}
+	}
+	if !tapped.IsZero() {
+		days.start = startOfDay(tapped.In(loc))
+	}
+	f.forecastDays = days
+}
+
+// countForecast adds a finished pour to the keg's cached daily totals, if they
+// have been read from the pour log. It must be called while holding the flow's
+// lock
+func (f *Flow) countForecast(pour Pour) {
+	days := f.forecastDays
+	if days == nil || !days.failed.IsZero() || days.keg != pour.keg || pour.StartTime.Before(days.tapped) {
+		return
+	}
+	days.add(pour)
+}
+
+// memoryDays totals the keg's pours kept in memory, which are never pruned
+// while the pour log is disabled. It must be called while holding the flow's
+// lock
+func (f *Flow) memoryDays(today time.Time) *pouredDays {
+	days := &pouredDays{
+		loc:   today.Location(),
+		daily: make(map[time.Time]float64),
+	}
+	for _, pour := range f.Pours {
+		if !pour.counted || pour.keg != f.keg.ID {
+			continue
+		}
+		if f.keg.TappedAt != nil && pour.StartTime.Before(*f.keg.TappedAt) {
+			continue
+		}
+		days.add(pour)
+	}
+
+	if f.keg.TappedAt != nil {
+		days.start = startOfDay(f.keg.TappedAt.In(today.Location()))
+	}
+	return days
+}
+
+// add totals a pour on its day. If the keg's tap time is unknown, its first day
+// is that of its oldest pour
+func (d *pouredDays) add(pour Pour) {
+	day := startOfDay(pour.StartTime.In(d.loc))
+	if d.start.IsZero() || day.Before(d.start) {
+		d.start = day
+	}
+	d.daily[day] += pour.Volume
+}
+
+// startOfDay returns midnight at the start of the day in t's location
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// dayClass returns 1 for weekends and 0 for weekdays
+func dayClass(t time.Time) int {
+	switch t.Weekday() {
+	case time.Saturday, time.Sunday:
+		return 1
+	}
+	return 0
+}
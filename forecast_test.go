@@ -0,0 +1,76 @@
+package kegerator
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// awaitForecast returns the flow's forecast once the pour log has been read
+func awaitForecast(t *testing.T, flow *Flow) *Forecast {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if forecast := flow.Forecast(); forecast != nil {
+			return forecast
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("no forecast once the pour log was read")
+	return nil
+}
+
+func TestLoggedForecast(t *testing.T) {
+	flow, clock, _ := newTestFlow(t)
+	tapped := testStart.AddDate(0, 0, -3) // friday
+	flow.Lock()
+	flow.keg.ID = "a"
+	flow.keg.TappedAt = &tapped
+	flow.Unlock()
+
+	l, err := NewPourLog(t.TempDir(), 1<<20, 0, clock)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer l.Close()
+
+	logPour := func(start time.Time, volume float64) {
+		t.Helper()
+		err := l.Append(PourEvent{
+			Pin:  17,
+			Pour: Pour{keg: "a", StartTime: start, Volume: volume},
+		})
+		if err != nil {
+			t.Fatalf("append: %s", err)
+		}
+	}
+	logPour(tapped.Add(time.Hour), 1)
+	logPour(tapped.AddDate(0, 0, 1), 2)
+
+	previous := GlobalPourLog
+	GlobalPourLog = l
+	defer func() { GlobalPourLog = previous }()
+
+	// no sunday pours count as zero
+	forecast := awaitForecast(t, flow)
+	if forecast.WeekdayRate != 1 || math.Abs(forecast.WeekendRate-1.4) > 1e-9 {
+		t.Errorf("rates = (%f, %f), want (1, 1.4)", forecast.WeekdayRate, forecast.WeekendRate)
+	}
+
+	// once read, the log is not read again, and pours are counted as they
+	// finish instead
+	logPour(tapped.AddDate(0, 0, 2), 5)
+	pour(flow, clock, 2*defaultPourEventThreshold, 50*time.Millisecond)
+	clock.Advance(defaultDeltaThreshold)
+	flow.Lock()
+	poured := flow.Pours[0].Volume
+	flow.Unlock()
+
+	clock.Set(testStart.AddDate(0, 0, 1))
+	forecast = flow.Forecast()
+	want := defaultForecastSmoothing*poured + (1-defaultForecastSmoothing)*1
+	if forecast == nil || math.Abs(forecast.WeekdayRate-want) > 1e-9 || math.Abs(forecast.WeekendRate-1.4) > 1e-9 {
+		t.Errorf("forecast = %+v, want rates (%f, 1.4)", forecast, want)
+	}
+}
@@ -0,0 +1,218 @@
+package kegerator
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/d2r2/go-dht"
+	"github.com/warthog618/gpiod"
+)
+
+// Bias and edge values accepted by LineConfig
+const (
+	BiasPullUp   = "pull-up"
+	BiasPullDown = "pull-down"
+	BiasDisabled = "disabled"
+	BiasAsIs     = "as-is"
+
+	EdgeFalling = "falling"
+	EdgeRising  = "rising"
+)
+
+// LineConfig describes how a flow meter's gpio line is requested. Zero values
+// use the defaults: the line numbered by the keg's pin on the default gpio chip,
+// with pull-up bias, detecting falling edges
+type LineConfig struct {
+	Chip      string `json:"chip,omitempty"`
+	Name      string `json:"name,omitempty"` // line name, e.g. GPIO17, used in place of pin
+	Bias      string `json:"bias,omitempty"`
+	Edge      string `json:"edge,omitempty"`
+	ActiveLow bool   `json:"active_low,omitempty"`
+	Debounce  string `json:"debounce,omitempty"` // duration, e.g. 2ms
+}
+
+// Validate checks that bias and edge values are known
+func (c LineConfig) Validate() error {
+	switch c.Bias {
+	case "", BiasPullUp, BiasPullDown, BiasDisabled, BiasAsIs:
+	default:
+		return fmt.Errorf("unknown bias %q", c.Bias)
+	}
+
+	switch c.Edge {
+	case "", EdgeFalling, EdgeRising:
+	default:
+		return fmt.Errorf("unknown edge %q", c.Edge)
+	}
+
+	if c.Debounce != "" {
+		debounce, err := time.ParseDuration(c.Debounce)
+		if err != nil {
+			return fmt.Errorf("parse debounce: %w", err)
+		}
+		if debounce < 0 {
+			return fmt.Errorf("negative debounce %s", c.Debounce)
+		}
+	}
+
+	return nil
+}
+
+// DebouncePeriod returns the configured debounce period, or zero if the
+// debounce period is unset or invalid
+func (c LineConfig) DebouncePeriod() time.Duration {
+	debounce, err := time.ParseDuration(c.Debounce)
+	if err != nil {
+		return 0
+	}
+	return debounce
+}
+
+// chip returns the configured gpio chip name, or the default chip
+func (c LineConfig) chip() string {
+	if c.Chip == "" {
+		return defaultGPIOChip
+	}
+	return c.Chip
+}
+
+// lineOption is satisfied by gpiod options that can configure either a single
+// line request or a subset of lines in a multi-line request
+type lineOption interface {
+	gpiod.LineReqOption
+	gpiod.SubsetLineConfigOption
+}
+
+// options returns the gpiod options corresponding to the line configuration.
+// Kernel debouncing requires Linux v5.10 or later, so it is only included if
+// debounce is set
+func (c LineConfig) options(debounce bool) []lineOption {
+	var options []lineOption
+	switch c.Bias {
+	case "", BiasPullUp:
+		options = append(options, gpiod.WithPullUp)
+	case BiasPullDown:
+		options = append(options, gpiod.WithPullDown)
+	case BiasDisabled:
+		options = append(options, gpiod.WithBiasDisabled)
+	case BiasAsIs:
+		options = append(options, gpiod.WithBiasAsIs)
+	}
+
+	switch c.Edge {
+	case "", EdgeFalling:
+		options = append(options, gpiod.WithFallingEdge)
+	case EdgeRising:
+		options = append(options, gpiod.WithRisingEdge)
+	}
+
+	if c.ActiveLow {
+		options = append(options, gpiod.AsActiveLow)
+	}
+
+	if period := c.DebouncePeriod(); debounce && period > 0 {
+		options = append(options, gpiod.WithDebounce(period))
+	}
+
+	return options
+}
+
+// FlowLine describes the line that a flow meter is attached to
+type FlowLine struct {
+	LineConfig
+	Pin    int
+	Sensor *FlowMeter
+}
+
+// Hardware provides the sensor interfaces that flow meters and DHT sensors
+// are attached to when state is loaded
+type Hardware interface {
+	// PulseSources returns a pulse source for each of the provided lines, in
+	// the same order. Lines requested by name have their Pin set to the
+	// resolved line offset
+	PulseSources(lines []FlowLine) ([]PulseSource, error)
+	DHTReader(pin int, model dht.SensorType) DHTReader
+}
+
+// GPIOHardware attaches sensors via gpio
+//
+// If Bank is set, every flow meter line on a chip is requested at once and
+// events from those lines are handled by a single event handler. Otherwise,
+// each flow meter line is requested separately
+type GPIOHardware struct {
+	Bank bool
+}
+
+func (h GPIOHardware) PulseSources(lines []FlowLine) ([]PulseSource, error) {
+	for i, line := range lines {
+		if line.Name == "" {
+			continue
+		}
+
+		offset, err := findLine(line.chip(), line.Name)
+		if err != nil {
+			return nil, err
+		}
+		lines[i].Pin = offset
+	}
+
+	sources := make([]PulseSource, len(lines))
+	if !h.Bank {
+		for i, line := range lines {
+			sources[i] = NewGPIOPulseSource(line.Pin, line.LineConfig)
+		}
+		return sources, nil
+	}
+
+	var chips []string
+	chipLines := make(map[string][]FlowLine)
+	for _, line := range lines {
+		chip := line.chip()
+		if _, ok := chipLines[chip]; !ok {
+			chips = append(chips, chip)
+		}
+		chipLines[chip] = append(chipLines[chip], line)
+	}
+
+	banks := make(map[string]*GPIOBank, len(chips))
+	for _, chip := range chips {
+		bank, err := NewGPIOBank(chip, chipLines[chip])
+		if err != nil {
+			for _, b := range banks {
+				b.Close()
+			}
+			return nil, fmt.Errorf("open flow bank on %s: %w", chip, err)
+		}
+		banks[chip] = bank
+	}
+	for i, line := range lines {
+		sources[i] = banks[line.chip()].Source(line.Pin)
+	}
+	return sources, nil
+}
+
+func (GPIOHardware) DHTReader(pin int, model dht.SensorType) DHTReader {
+	return NewGPIODHTReader(model, pin)
+}
+
+// findLine returns the offset of the named line on a gpio chip
+func findLine(chip, name string) (int, error) {
+	c, err := gpiod.NewChip(chip)
+	if err != nil {
+		return 0, fmt.Errorf("open chip %s: %w", chip, err)
+	}
+	defer c.Close()
+
+	for offset := 0; offset < c.Lines(); offset++ {
+		info, err := c.LineInfo(offset)
+		if err != nil {
+			return 0, fmt.Errorf("read %s line %d info: %w", chip, offset, err)
+		}
+		if strings.EqualFold(info.Name, name) {
+			return offset, nil
+		}
+	}
+
+	return 0, fmt.Errorf("line %q not found on %s", name, chip)
+}
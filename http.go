@@ -1,19 +1,25 @@
 package kegerator
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"net/http"
-	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/subtlepseudonym/kegerator/prometheus"
 )
 
-const defaultPourLimit = 100
+const (
+	defaultPourLimit    = 100
+	defaultReadingLimit = 1440    // a day of readings from one sensor at the default interval
+	defaultBeerXMLSize  = 1 << 20 // bytes accepted in a BeerXML document
+)
 
 func StateHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -32,89 +38,278 @@ func StateHandler(w http.ResponseWriter, r *http.Request) {
 	GlobalState.mu.Unlock()
 }
 
+// RefillHandler refills the keg on the requested pin, writing the archived
+// totals of the outgoing keg. The keg is replaced if a keg type, ID or volume
+// is provided, otherwise it is refilled in place
 func RefillHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	var err error
-	var pin int
-	if r.FormValue("pin") != "" {
-		pin, err = strconv.Atoi(r.FormValue("pin"))
+	flow := requestFlow(w, r)
+	if flow == nil {
+		return
+	}
+
+	refill, err := parseRefill(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+
+	archive, err := GlobalState.Refill(flow, refill)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+	log.Printf("Refilled %d with contents: %s", archive.Pin, archive.RefilledWith)
+
+	err = json.NewEncoder(w).Encode(archive)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("marshal keg archive: %s", err)
+		return
+	}
+}
+
+// ArchiveHandler lists the totals of refilled and replaced kegs, newest first.
+// Archives are read from the archive log if there is one, otherwise only the
+// most recent, kept in the state, are listed. The from query param limits the
+// list to kegs archived since an RFC3339 time
+func ArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var from time.Time
+	if r.FormValue("from") != "" {
+		var err error
+		from, err = time.Parse(time.RFC3339, r.FormValue("from"))
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf(`{"msg": "bad pin value": "error": %q}`, err)))
+			w.Write([]byte(fmt.Sprintf(`{"msg": "bad from value", "error": %q}`, err)))
+			return
+		}
+	}
+
+	var archives []KegArchive
+	if GlobalArchiveLog != nil {
+		var err error
+		archives, err = GlobalArchiveLog.List(from)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("ERR: read archive log: %s\n", err)
 			return
 		}
 	} else {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error": "pin query param required"}`))
+		GlobalState.mu.Lock()
+		for _, archive := range GlobalState.Archive {
+			if !archive.Time.Before(from) {
+				archives = append(archives, archive)
+			}
+		}
+		GlobalState.mu.Unlock()
+	}
+
+	newest := make([]KegArchive, len(archives))
+	for i, archive := range archives {
+		newest[len(archives)-1-i] = archive
+	}
+	err := json.NewEncoder(w).Encode(newest)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("marshal keg archives: %s", err)
 		return
 	}
+}
 
-	var flow *Flow
-	GlobalState.mu.Lock()
-	for _, keg := range GlobalState.Kegs {
-		if keg.pinNumber == pin {
-			flow = keg
-			break
-		}
+// BeerXMLRefillHandler refills the keg on the requested pin, as RefillHandler,
+// describing the beer with a recipe from the BeerXML document in the request
+// body. The recipe is selected by the recipe query param, which may be omitted
+// if the document contains a single recipe
+func BeerXMLRefillHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
 	}
-	GlobalState.mu.Unlock()
+
+	// the body is read before any query params, so that it is not mistaken
+	// for a form
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, defaultBeerXMLSize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+
+	flow := requestFlow(w, r)
 	if flow == nil {
+		return
+	}
+
+	beer, err := ImportBeerXML(bytes.NewReader(data), r.FormValue("recipe"))
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf(`{"error": "no keg found on pin %d"}`, pin)))
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+	refill, err := parseRefill(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
 		return
 	}
+	refill.Beer = beer
 
-	contents := flow.Contents
-	if r.FormValue("contents") != "" {
-		contents = r.FormValue("contents")
+	archive, err := GlobalState.Refill(flow, refill)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
 	}
-	log.Printf("Refilling %d with contents: %s", pin, contents)
+	log.Printf("Refilled %d with recipe: %s", flow.Pin(), beer.Name)
 
-	GlobalState.mu.Lock()
-	flow.Refill(contents)
-	GlobalState.mu.Unlock()
+	err = json.NewEncoder(w).Encode(archive)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("marshal keg archive: %s", err)
+		return
+	}
 }
 
-func CalibrateHandler(w http.ResponseWriter, r *http.Request) {
+// parseRefill reads a refill from the contents, keg, id, volume and remaining
+// query params, along with the beer read by parseBeer. Volumes are in liters
+func parseRefill(r *http.Request) (Refill, error) {
+	var volumes [2]float64
+	for i, param := range []string{"volume", "remaining"} {
+		if r.FormValue(param) == "" {
+			continue
+		}
+		var err error
+		volumes[i], err = strconv.ParseFloat(r.FormValue(param), 64)
+		if err != nil {
+			return Refill{}, fmt.Errorf("bad %s value: %w", param, err)
+		}
+	}
+
+	keg, err := NewRefillKeg(r.FormValue("keg"), r.FormValue("id"), volumes[0])
+	if err != nil {
+		return Refill{}, err
+	}
+	beer, err := parseBeer(r)
+	if err != nil {
+		return Refill{}, err
+	}
+	return Refill{
+		Keg:       keg,
+		Contents:  r.FormValue("contents"),
+		Beer:      beer,
+		Remaining: volumes[1],
+	}, nil
+}
+
+// parseBeer reads a beer from the name, brewery, style, abv, ibu, srm,
+// description and serving_temperature query params. If name is unset, nil is
+// returned
+func parseBeer(r *http.Request) (*Beer, error) {
+	if r.FormValue("name") == "" {
+		return nil, nil
+	}
+
+	beer := &Beer{
+		Name:        r.FormValue("name"),
+		Brewery:     r.FormValue("brewery"),
+		Style:       r.FormValue("style"),
+		Description: r.FormValue("description"),
+	}
+	measurements := map[string]*float64{
+		"abv":                 &beer.ABV,
+		"ibu":                 &beer.IBU,
+		"srm":                 &beer.SRM,
+		"serving_temperature": &beer.ServingTemperature,
+	}
+	for param, value := range measurements {
+		if r.FormValue(param) == "" {
+			continue
+		}
+		var err error
+		*value, err = strconv.ParseFloat(r.FormValue(param), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s value: %w", param, err)
+		}
+	}
+	return beer, nil
+}
+
+// BeerHandler describes the beer on the requested pin. If a name is provided,
+// the beer is first replaced with the one described by the query params
+func BeerHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	var err error
-	var pin int
-	if r.FormValue("pin") != "" {
-		pin, err = strconv.Atoi(r.FormValue("pin"))
+	flow := requestFlow(w, r)
+	if flow == nil {
+		return
+	}
+
+	beer, err := parseBeer(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+	if beer != nil {
+		err = flow.SetBeer(beer)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf(`{"msg": "bad pin value": "error": %q}`, err)))
+			w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
 			return
 		}
-	} else {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error": "pin query param required"}`))
+		log.Printf("Described %d as %s", flow.Pin(), beer.Name)
+	}
+
+	err = json.NewEncoder(w).Encode(flow.Beer())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("marshal beer: %s", err)
 		return
 	}
+}
 
-	var flow *Flow
-	GlobalState.mu.Lock()
-	for _, keg := range GlobalState.Kegs {
-		if keg.pinNumber == pin {
-			flow = keg
-			break
-		}
+// TapListHandler lists what is on each tap, along with the volume remaining,
+// for rendering menus
+func TapListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
 	}
-	GlobalState.mu.Unlock()
+
+	err := json.NewEncoder(w).Encode(GlobalState.TapList())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("marshal tap list: %s", err)
+		return
+	}
+}
+
+func CalibrateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flow := requestFlow(w, r)
 	if flow == nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf(`{"error": "no keg found on pin %d"}`, pin)))
 		return
 	}
 
+	var err error
 	var constant float64
 	if r.FormValue("constant") != "" {
 		constant, err = strconv.ParseFloat(r.FormValue("constant"), 64)
@@ -130,11 +325,10 @@ func CalibrateHandler(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(fmt.Sprintf(`{"msg": "bad constant value": "error": %q}`, err)))
 			return
 		}
-		// round to 2 decimal places
-		constant = math.Floor(flow.sensor.FlowConstant*coef*100) / 100
+		constant = scaledFlowConstant(flow.sensor.FlowConstant, coef)
 
 		if constant == flow.sensor.FlowConstant {
-			log.Printf("WARN: %d flow constant unchanged: %.2f", pin, constant)
+			log.Printf("WARN: %d flow constant unchanged: %.2f", flow.Pin(), constant)
 			return
 		}
 	} else {
@@ -144,50 +338,542 @@ func CalibrateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	GlobalState.mu.Lock()
-	flow.sensor.FlowConstant = constant
-	flow.flowPerEvent = 1.0 / (constant * 60.0)
+	flow.SetFlowConstant(constant)
 	GlobalState.mu.Unlock()
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// CalibrationStartHandler begins a calibration session on the keg's flow meter.
+// Once the session is started, a known volume should be poured and then passed
+// to CalibrationFinishHandler
+func CalibrationStartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flow := requestFlow(w, r)
+	if flow == nil {
+		return
+	}
+
+	session, err := flow.StartCalibration()
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+	log.Printf("Starting calibration on %d", flow.Pin())
+
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(session)
+	if err != nil {
+		log.Printf("marshal calibration session: %s", err)
+	}
+}
+
+// CalibrationStatusHandler reports the pulses counted by the calibration session
+// in progress
+func CalibrationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flow := requestFlow(w, r)
+	if flow == nil {
+		return
+	}
+
+	session, ok := flow.Calibration()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "no calibration in progress"}`))
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(session)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("marshal calibration session: %s", err)
+		return
+	}
+}
+
+// CalibrationFinishHandler ends the calibration session in progress, given the
+// volume that was poured, in liters, and sets the new flow constant
+func CalibrationFinishHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flow := requestFlow(w, r)
+	if flow == nil {
+		return
+	}
+
+	if r.FormValue("volume") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "volume query param required"}`))
+		return
+	}
+	volume, err := strconv.ParseFloat(r.FormValue("volume"), 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"msg": "bad volume value", "error": %q}`, err)))
+		return
+	}
+
+	GlobalState.mu.Lock()
+	record, err := flow.FinishCalibration(volume)
+	GlobalState.mu.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+	log.Printf(
+		"Calibrated %d: flow constant %.2f -> %.2f, error %.2f%%",
+		flow.Pin(),
+		record.PreviousConstant,
+		record.FlowConstant,
+		record.Error*100,
+	)
+
+	err = json.NewEncoder(w).Encode(record)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("marshal calibration record: %s", err)
+		return
+	}
+}
+
+// CalibrationCancelHandler ends the calibration session in progress without
+// changing the flow constant
+func CalibrationCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flow := requestFlow(w, r)
+	if flow == nil {
+		return
+	}
+
+	err := flow.CancelCalibration()
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+}
+
+// CalibrationHistoryHandler lists past calibration sessions for the keg's flow
+// meter
+func CalibrationHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flow := requestFlow(w, r)
+	if flow == nil {
+		return
+	}
+
+	flow.Lock()
+	history := make([]CalibrationRecord, len(flow.sensor.CalibrationHistory))
+	copy(history, flow.sensor.CalibrationHistory)
+	flow.Unlock()
+
+	err := json.NewEncoder(w).Encode(history)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("marshal calibration history: %s", err)
+		return
+	}
+}
+
+// KickHandler marks the keg as kicked and proposes a flow constant from the
+// pulses counted since the keg was refilled. The proposal is applied if the
+// keg has automatic calibration enabled
+func KickHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flow := requestFlow(w, r)
+	if flow == nil {
+		return
+	}
+
+	GlobalState.mu.Lock()
+	proposal, err := flow.Kick()
+	GlobalState.mu.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+	log.Printf("Kicked %d", flow.Pin())
+
+	err = json.NewEncoder(w).Encode(proposal)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("marshal kick proposal: %s", err)
+		return
+	}
+}
+
+// CalibrationProposalHandler reports the flow constant proposed when the keg
+// was last kicked, if it has not been applied
+func CalibrationProposalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flow := requestFlow(w, r)
+	if flow == nil {
+		return
+	}
+
+	proposal, ok := flow.Proposal()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "no proposed flow constant"}`))
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(proposal)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("marshal kick proposal: %s", err)
+		return
+	}
+}
+
+// CalibrationApplyHandler sets the flow constant proposed when the keg was last
+// kicked
+func CalibrationApplyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flow := requestFlow(w, r)
+	if flow == nil {
+		return
+	}
+
+	GlobalState.mu.Lock()
+	proposal, err := flow.ApplyProposal()
+	GlobalState.mu.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(proposal)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("marshal kick proposal: %s", err)
+		return
+	}
+}
+
+// PourDetectionHandler reports the thresholds used to group the keg's flow
+// meter pulses into pours. Thresholds provided as query params are applied
+// immediately
+func PourDetectionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flow := requestFlow(w, r)
+	if flow == nil {
+		return
+	}
+
+	detection := flow.PourDetection()
+	if r.FormValue("delta_threshold") != "" {
+		detection.DeltaThreshold = r.FormValue("delta_threshold")
+	}
+	if r.FormValue("event_threshold") != "" {
+		events, err := strconv.Atoi(r.FormValue("event_threshold"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf(`{"msg": "bad event threshold value", "error": %q}`, err)))
+			return
+		}
+		detection.EventThreshold = events
+	}
+
+	GlobalState.mu.Lock()
+	err := flow.SetPourDetection(detection)
+	GlobalState.mu.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(flow.PourDetection())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("marshal pour detection: %s", err)
+		return
+	}
+}
+
+// PourHandler lists pours matching the query params, newest first by default.
+// If more pours match than the limit, the X-Next-Cursor header is set to the
+// cursor for the next page. Finished pours are read from the pour log if there
+// is one, otherwise from the pours kept in memory, and pours in progress are
+// always read from memory. Pours are exported as CSV or NDJSON if requested by
+// the format query param or Accept header
 func PourHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	limit := defaultPourLimit
-	if r.FormValue("limit") != "" {
-		var err error
-		limit, err = strconv.Atoi(r.FormValue("limit"))
+	format, err := exportFormat(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+	query, err := ParsePourQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+	if format != FormatJSON && r.URL.Query().Get("limit") == "" {
+		query.Limit = 0 // exports include every matching pour by default
+	}
+	writePours(w, query, format)
+}
+
+// KegHandler lists every known keg at /kegs and describes a single keg at
+// /kegs/{id}. A keg's lifecycle is managed with the following paths:
+//
+//	/kegs/{id}/pours          lists the keg's pours, as PourHandler
+//	/kegs/{id}/tap?pin=       moves the keg onto the flow meter attached to pin
+//	/kegs/{id}/clean          marks a kicked keg as cleaned
+//	/kegs/{id}/fill?contents= marks a stored, cleaned keg as filled
+//	/kegs/{id}/remove         removes a stored keg from the cellar
+func KegHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/kegs"), "/")
+	if path == "" {
+		err := json.NewEncoder(w).Encode(GlobalState.ListKegs())
 		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("marshal kegs: %s", err)
+		}
+		return
+	}
+
+	id, resource, _ := strings.Cut(path, "/")
+	var err error
+	switch resource {
+	case "":
+		keg, ok := GlobalState.FindKeg(id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf(`{"error": "no keg found with id %q"}`, id)))
+			return
+		}
+		err = json.NewEncoder(w).Encode(keg)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("marshal keg: %s", err)
+		}
+		return
+	case "pours":
+		kegPours(w, r, id)
+		return
+	case "tap":
+		var pin int
+		pin, err = strconv.Atoi(r.FormValue("pin"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf(`{"msg": "bad pin value", "error": %q}`, err)))
+			return
+		}
+		err = GlobalState.TapKeg(id, pin)
+		if err == nil {
+			log.Printf("Tapped keg %s on %d", id, pin)
+		}
+	case "clean":
+		err = GlobalState.CleanKeg(id)
+	case "fill":
+		if r.FormValue("contents") == "" {
 			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "contents query param required"}`))
+			return
+		}
+		err = GlobalState.FillKeg(id, r.FormValue("contents"))
+	case "remove":
+		err = GlobalState.RemoveKeg(id)
+		if err == nil {
+			log.Printf("Removed keg %s", id)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+}
+
+// kegPours lists the pours from a single keg. It accepts the same query params
+// as PourHandler
+func kegPours(w http.ResponseWriter, r *http.Request, id string) {
+	format, err := exportFormat(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+	query, err := ParsePourQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return
+	}
+	if format != FormatJSON && r.URL.Query().Get("limit") == "" {
+		query.Limit = 0 // exports include every matching pour by default
+	}
+	query.Keg = id
+	writePours(w, query, format)
+}
+
+// writePours writes a page of pours matching the query in the provided format.
+// Finished pours are read from the pour log if there is one, and pours still
+// in progress from memory. Exports without a limit are written as the log is
+// read, see exportPours
+func writePours(w http.ResponseWriter, query PourQuery, format string) {
+	if GlobalPourLog != nil && format != FormatJSON && query.Limit <= 0 {
+		exportPours(w, query, format)
+		return
+	}
+
+	var pours []PourEvent
+	var err error
+	if GlobalPourLog != nil {
+		// the log is read first so that a pour finishing in the meantime is
+		// missed rather than listed twice
+		pours, err = GlobalPourLog.match(query)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("ERR: read pour log: %s\n", err)
 			return
 		}
 	}
 
 	GlobalState.mu.Lock()
-	var pours []Pour
 	for _, keg := range GlobalState.Kegs {
-		pours = append(pours, keg.Pours...)
+		keg.Lock()
+		for _, pour := range keg.Pours {
+			if GlobalPourLog == nil || !pour.finished {
+				pours = append(pours, keg.pourEvent(pour))
+			}
+		}
+		keg.Unlock()
 	}
 	GlobalState.mu.Unlock()
 
-	sort.Slice(pours, func(i, j int) bool {
-		return pours[i].StartTime.After(pours[j].StartTime)
-	})
-	if len(pours) > limit {
-		pours = pours[:limit]
+	page, next, err := query.Apply(pours)
+	if err != nil {
+		// the query was checked when it was parsed
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("ERR: query pours: %s\n", err)
+		return
 	}
 
-	err := json.NewEncoder(w).Encode(pours)
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	setExportHeaders(w, format, "pours")
+	if format != FormatJSON {
+		err = writePourExport(w, format, page)
+		if err != nil {
+			log.Printf("write pours: %s", err)
+		}
+		return
+	}
+
+	list := make([]Pour, len(page))
+	for i, pour := range page {
+		list[i] = pour.Pour
+	}
+	err = json.NewEncoder(w).Encode(list)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("marshal state: %s", err)
+		log.Printf("marshal pours: %s", err)
 		return
 	}
 }
 
+// requestFlow returns the keg specified by the pin query parameter. If the
+// parameter is missing or no keg is found, an error is written to the response
+// and nil is returned
+func requestFlow(w http.ResponseWriter, r *http.Request) *Flow {
+	if r.FormValue("pin") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "pin query param required"}`))
+		return nil
+	}
+
+	pin, err := strconv.Atoi(r.FormValue("pin"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"msg": "bad pin value", "error": %q}`, err)))
+		return nil
+	}
+
+	flow := findFlow(pin)
+	if flow == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": "no keg found on pin %d"}`, pin)))
+		return nil
+	}
+	return flow
+}
+
+// findFlow returns the keg attached to pin, or nil if there is none
+func findFlow(pin int) *Flow {
+	GlobalState.mu.Lock()
+	defer GlobalState.mu.Unlock()
+	for _, keg := range GlobalState.Kegs {
+		if keg.pinNumber == pin {
+			return keg
+		}
+	}
+	return nil
+}
+
+// scaledFlowConstant multiplies a flow constant by coef, rounded down to 2
+// decimal places
+func scaledFlowConstant(constant, coef float64) float64 {
+	return math.Floor(constant*coef*100) / 100
+}
+
 func OKHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
@@ -196,13 +882,19 @@ func MetricsHandler(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		now := time.Now()
 		GlobalState.mu.Lock()
+		prometheus.KegEmptyETA.Reset() // kegs that are no longer forecast to run out
 		for _, keg := range GlobalState.Kegs {
 			keg.mu.Lock()
-			prometheus.RemainingVolume.WithLabelValues(
+			labels := []string{
 				strconv.Itoa(keg.Pin()),
 				keg.Keg().Type,
 				keg.Contents,
-			).Set(keg.RemainingVolume())
+			}
+			prometheus.RemainingVolume.WithLabelValues(labels...).Set(keg.RemainingVolume())
+			if forecast := keg.forecast(); forecast != nil && forecast.Empty != nil {
+				eta := math.Max(forecast.Empty.Sub(keg.clock.Now()).Seconds(), 0)
+				prometheus.KegEmptyETA.WithLabelValues(labels...).Set(eta)
+			}
 			keg.mu.Unlock()
 		}
 		GlobalState.mu.Unlock()
@@ -0,0 +1,271 @@
+package kegerator
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jsonLogSuffix     = ".jsonl"
+	jsonLogTimeFormat = "20060102T150405.000"
+)
+
+// errStopRead may be returned by a log's decode function to stop reading
+// without an error
+var errStopRead = errors.New("stop reading")
+
+// jsonLog appends records to a JSON Lines file named for the log. Once the file
+// exceeds its maximum size, it is renamed with the time of rotation and a new
+// file is started. Rotated files older than the retention period are removed
+type jsonLog struct {
+	dir       string
+	name      string
+	maxSize   int64
+	retention time.Duration // zero retains records indefinitely
+	clock     Clock
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// openJSONLog opens the named log in dir, creating the directory if necessary
+func openJSONLog(dir, name string, maxSize int64, retention time.Duration, clock Clock) (*jsonLog, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("create %s log directory: %w", name, err)
+	}
+
+	l := &jsonLog{
+		dir:       dir,
+		name:      name,
+		maxSize:   maxSize,
+		retention: retention,
+		clock:     clock,
+	}
+	err = l.open()
+	if err != nil {
+		return nil, err
+	}
+
+	err = l.prune()
+	if err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *jsonLog) path() string {
+	return filepath.Join(l.dir, l.name+jsonLogSuffix)
+}
+
+// open must be called while holding the log's lock, or before the log is used
+func (l *jsonLog) open() error {
+	f, err := os.OpenFile(l.path(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open %s log: %w", l.name, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat %s log: %w", l.name, err)
+	}
+
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// append writes a record to the log, rotating the log first if the record
+// would exceed its maximum size
+func (l *jsonLog) append(record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", l.name, err)
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write %s log: %w", l.name, err)
+	}
+	return nil
+}
+
+// rotate must be called while holding the log's lock
+func (l *jsonLog) rotate() error {
+	err := l.file.Close()
+	if err != nil {
+		return fmt.Errorf("close %s log: %w", l.name, err)
+	}
+
+	rotated := l.name + "-" + l.clock.Now().UTC().Format(jsonLogTimeFormat) + jsonLogSuffix
+	err = os.Rename(l.path(), filepath.Join(l.dir, rotated))
+	if err != nil {
+		return fmt.Errorf("rotate %s log: %w", l.name, err)
+	}
+
+	err = l.open()
+	if err != nil {
+		return err
+	}
+	return l.prune()
+}
+
+// rotatedFiles returns the rotated log files, oldest first, along with the time
+// that each was rotated
+func (l *jsonLog) rotatedFiles() ([]string, []time.Time, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read %s log directory: %w", l.name, err)
+	}
+
+	prefix := l.name + "-"
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, jsonLogSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var files []string
+	var times []time.Time
+	for _, name := range names {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), jsonLogSuffix)
+		rotated, err := time.Parse(jsonLogTimeFormat, stamp)
+		if err != nil {
+			log.Printf("WARN: unrecognized %s log %q\n", l.name, name)
+			continue
+		}
+		files = append(files, filepath.Join(l.dir, name))
+		times = append(times, rotated)
+	}
+	return files, times, nil
+}
+
+// cutoff returns the time before which records are no longer retained, or the
+// zero time if records are retained indefinitely
+func (l *jsonLog) cutoff() time.Time {
+	if l.retention <= 0 {
+		return time.Time{}
+	}
+	return l.clock.Now().Add(-l.retention)
+}
+
+// prune removes rotated logs whose records are all older than the retention
+// period
+func (l *jsonLog) prune() error {
+	if l.retention <= 0 {
+		return nil
+	}
+
+	files, times, err := l.rotatedFiles()
+	if err != nil {
+		return err
+	}
+
+	cutoff := l.cutoff()
+	for i, file := range files {
+		if !times[i].Before(cutoff) {
+			break
+		}
+		err = os.Remove(file)
+		if err != nil {
+			return fmt.Errorf("remove expired %s log: %w", l.name, err)
+		}
+	}
+	return nil
+}
+
+// read passes each record to decode, oldest file first. Records in a rotated
+// log were written before it was rotated, so rotated logs older than from are
+// not read. Records that cannot be decoded, such as one left by a partial
+// write, are skipped. If decode returns errStopRead, no further records are read
+//
+// The log is only locked while listing its files, so that a slow reader does
+// not hold up appends. Files removed by pruning while the log is read are
+// skipped
+func (l *jsonLog) read(from time.Time, decode func([]byte) error) error {
+	l.mu.Lock()
+	files, times, err := l.rotatedFiles()
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var read []string
+	for i, file := range files {
+		if !from.IsZero() && times[i].Before(from) {
+			continue
+		}
+		read = append(read, file)
+	}
+	read = append(read, l.path())
+
+	for _, file := range read {
+		err = readJSONLog(file, decode)
+		if errors.Is(err, errStopRead) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readJSONLog(file string, decode func([]byte) error) error {
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open log: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		err = decode(scanner.Bytes())
+		if errors.Is(err, errStopRead) {
+			return err
+		}
+		if err != nil {
+			log.Printf("WARN: %s: skipping malformed record: %s\n", file, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read %s: %w", file, err)
+	}
+	return nil
+}
+
+func (l *jsonLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
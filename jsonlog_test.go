@@ -0,0 +1,159 @@
+package kegerator
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testRecord is 8 bytes once marshalled, including the trailing newline
+type testRecord struct {
+	N int `json:"n"`
+}
+
+// readRecords returns the numbers of the records read from the log
+func readRecords(t *testing.T, l *jsonLog, from time.Time) []int {
+	t.Helper()
+
+	var records []int
+	err := l.read(from, func(data []byte) error {
+		var record testRecord
+		err := json.Unmarshal(data, &record)
+		if err != nil {
+			return err
+		}
+		records = append(records, record.N)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	return records
+}
+
+// rotatedTimes returns the rotation times of the log's rotated files
+func rotatedTimes(t *testing.T, l *jsonLog) []time.Time {
+	t.Helper()
+
+	_, times, err := l.rotatedFiles()
+	if err != nil {
+		t.Fatalf("rotated files: %s", err)
+	}
+	return times
+}
+
+func TestJSONLogRotation(t *testing.T) {
+	clock := NewManualClock(testStart)
+	l, err := openJSONLog(filepath.Join(t.TempDir(), "log"), "test", 20, 0, clock)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer l.close()
+
+	// two records fit in each file, and each rotated file is named for the
+	// time of the append that rotated it
+	var appended []time.Time
+	for i := 0; i < 5; i++ {
+		appended = append(appended, clock.Now())
+		err = l.append(testRecord{N: i})
+		if err != nil {
+			t.Fatalf("append %d: %s", i, err)
+		}
+		clock.Advance(time.Hour)
+	}
+
+	want := []time.Time{appended[2], appended[4]}
+	if times := rotatedTimes(t, l); !reflect.DeepEqual(times, want) {
+		t.Errorf("rotated = %v, want %v", times, want)
+	}
+	if l.size != 8 {
+		t.Errorf("size = %d, want 8", l.size)
+	}
+
+	if records := readRecords(t, l, time.Time{}); !reflect.DeepEqual(records, []int{0, 1, 2, 3, 4}) {
+		t.Errorf("records = %v, want all records", records)
+	}
+	// files rotated before from cannot hold records written after it
+	if records := readRecords(t, l, appended[3]); !reflect.DeepEqual(records, []int{2, 3, 4}) {
+		t.Errorf("records from %s = %v, want [2 3 4]", appended[3], records)
+	}
+}
+
+func TestJSONLogRetention(t *testing.T) {
+	clock := NewManualClock(testStart)
+	dir := filepath.Join(t.TempDir(), "log")
+	l, err := openJSONLog(dir, "test", 20, 3*time.Hour, clock)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+
+	var appended []time.Time
+	for i := 0; i < 7; i++ {
+		appended = append(appended, clock.Now())
+		err = l.append(testRecord{N: i})
+		if err != nil {
+			t.Fatalf("append %d: %s", i, err)
+		}
+		clock.Advance(time.Hour)
+	}
+
+	// expired files are pruned as the log rotates
+	want := []time.Time{appended[4], appended[6]}
+	if times := rotatedTimes(t, l); !reflect.DeepEqual(times, want) {
+		t.Errorf("rotated = %v, want %v", times, want)
+	}
+	if records := readRecords(t, l, time.Time{}); !reflect.DeepEqual(records, []int{2, 3, 4, 5, 6}) {
+		t.Errorf("records = %v, want [2 3 4 5 6]", records)
+	}
+
+	// and when the log is opened
+	err = l.close()
+	if err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	clock.Advance(2 * time.Hour)
+	l, err = openJSONLog(dir, "test", 20, 3*time.Hour, clock)
+	if err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+	defer l.close()
+
+	want = []time.Time{appended[6]}
+	if times := rotatedTimes(t, l); !reflect.DeepEqual(times, want) {
+		t.Errorf("rotated after reopening = %v, want %v", times, want)
+	}
+}
+
+func TestJSONLogStopRead(t *testing.T) {
+	clock := NewManualClock(testStart)
+	l, err := openJSONLog(filepath.Join(t.TempDir(), "log"), "test", 20, 0, clock)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer l.close()
+
+	for i := 0; i < 5; i++ {
+		err = l.append(testRecord{N: i})
+		if err != nil {
+			t.Fatalf("append %d: %s", i, err)
+		}
+		clock.Advance(time.Millisecond)
+	}
+
+	var read int
+	err = l.read(time.Time{}, func([]byte) error {
+		read++
+		if read == 3 {
+			return errStopRead
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if read != 3 {
+		t.Errorf("read %d records, want 3", read)
+	}
+}
@@ -1,12 +1,44 @@
 package kegerator
 
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Keg lifecycle states, in the order that a keg normally passes through them
+const (
+	KegStateFilled  = "filled"  // filled, but not yet tapped
+	KegStateTapped  = "tapped"  // tapped, but not yet poured from
+	KegStateServing = "serving" // poured from
+	KegStateKicked  = "kicked"  // emptied
+	KegStateCleaned = "cleaned" // cleaned and ready to be filled
+)
+
+// kegTransitions lists the states that a keg may move to from each state
+var kegTransitions = map[string][]string{
+	KegStateFilled:  {KegStateTapped},
+	KegStateTapped:  {KegStateServing, KegStateKicked},
+	KegStateServing: {KegStateKicked},
+	KegStateKicked:  {KegStateCleaned},
+	KegStateCleaned: {KegStateFilled},
+}
+
 type Keg struct {
+	ID     string  `json:"id,omitempty"`
 	Type   string  `json:"type"`
 	Volume float64 `json:"volume"`
+
+	State     string     `json:"state,omitempty"`
+	FilledAt  *time.Time `json:"filled_at,omitempty"`
+	TappedAt  *time.Time `json:"tapped_at,omitempty"`
+	KickedAt  *time.Time `json:"kicked_at,omitempty"`
+	CleanedAt *time.Time `json:"cleaned_at,omitempty"`
 }
 
-// These values are here for reference, but are not actually used
-// Actual Volume values are loaded from file
+// Reference kegs, which may be requested by type when refilling. The kegs in
+// the state file are loaded with their own volumes
 var (
 	KegCorny = Keg{ // cornelius
 		Type:   "corny",
@@ -25,3 +57,312 @@ var (
 		Volume: 58.67,
 	}
 )
+
+// newKegID returns a random keg ID
+func newKegID() string {
+	id := make([]byte, 6)
+	_, err := rand.Read(id)
+	if err != nil {
+		// the time is unique enough for a handful of kegs
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// Validate checks that the keg's volume is not negative and its state is known
+func (k *Keg) Validate() error {
+	if k.Volume < 0 {
+		return fmt.Errorf("negative keg volume %.2f", k.Volume)
+	}
+	if _, ok := kegTransitions[k.State]; k.State != "" && !ok {
+		return fmt.Errorf("unknown keg state %q", k.State)
+	}
+	return nil
+}
+
+// transition moves the keg to the provided state, recording the time of the
+// transition. Moving a keg to the state it is already in has no effect
+func (k *Keg) transition(state string, now time.Time) error {
+	if k.State == state {
+		return nil
+	}
+
+	allowed := k.State == ""
+	for _, next := range kegTransitions[k.State] {
+		allowed = allowed || next == state
+	}
+	if !allowed {
+		return fmt.Errorf("keg %s cannot move from %s to %s", k.ID, k.State, state)
+	}
+
+	switch state {
+	case KegStateFilled:
+		k.FilledAt = &now
+		k.TappedAt, k.KickedAt, k.CleanedAt = nil, nil, nil
+	case KegStateTapped:
+		k.TappedAt = &now
+	case KegStateKicked:
+		k.KickedAt = &now
+	case KegStateCleaned:
+		k.CleanedAt = &now
+	}
+	k.State = state
+	return nil
+}
+
+// refill marks a keg as filled and tapped in place. It must be called while
+// holding the lock of the flow that the keg is tapped on
+func (k *Keg) refill(now time.Time) {
+	k.State = KegStateTapped
+	k.FilledAt, k.TappedAt = &now, &now
+	k.KickedAt, k.CleanedAt = nil, nil
+}
+
+// StoredKeg is a keg that is not tapped, along with the state that moves with
+// it between taps
+type StoredKeg struct {
+	Keg      *Keg           `json:"keg"`
+	Contents string         `json:"contents"`
+	Beer     *Beer          `json:"beer,omitempty"`
+	Poured   []PouredVolume `json:"poured_by_constant,omitempty"`
+}
+
+// KegInfo describes a keg and the tap that it is on, if any
+type KegInfo struct {
+	Keg
+	Pin      *int    `json:"pin,omitempty"`
+	Contents string  `json:"contents"`
+	Beer     *Beer   `json:"beer,omitempty"`
+	Poured   float64 `json:"poured"`
+}
+
+// untap returns the flow's keg along with the volume poured from it. A keg
+// that has not been poured from returns to being filled, while one that has is
+// still serving. It must be called while holding the flow's lock
+func (f *Flow) untap() StoredKeg {
+	// pours in progress belong to the outgoing keg, so they are ended before
+	// it moves rather than carrying on into the next keg's totals
+	f.endPours()
+	if f.keg.State == KegStateTapped {
+		f.keg.State = KegStateFilled
+	}
+	return StoredKeg{
+		Keg:      f.keg,
+		Contents: f.Contents,
+		Beer:     f.beer,
+		Poured:   f.Dispensed(),
+	}
+}
+
+// tap replaces the flow's keg. Pulses counted before the keg was tapped are
+// unknown, so a keg that has already been poured from cannot be used to
+// propose a flow constant. It must be called while holding the flow's lock
+func (f *Flow) tap(stored StoredKeg) {
+	now := f.clock.Now()
+	f.keg = stored.Keg
+	f.Contents = stored.Contents
+	f.beer = stored.Beer
+	f.setDispensed(stored.Poured)
+	f.pulseTotal = 0
+	f.partial = f.TotalFlow() > 0
+	f.kicked = f.keg.State == KegStateKicked
+	f.proposal = nil
+	f.foam.reset()
+	switch f.keg.State {
+	case "", KegStateFilled:
+		f.keg.transition(KegStateTapped, now)
+	case KegStateTapped, KegStateServing:
+		f.keg.TappedAt = &now
+	}
+
+	f.publish(KegTapped{
+		Time:     now,
+		Pin:      f.pinNumber,
+		Keg:      f.keg.ID,
+		Contents: f.Contents,
+	})
+}
+
+// kegInfo must be called while holding the flow's lock
+func (f *Flow) kegInfo() KegInfo {
+	pin := f.pinNumber
+	return KegInfo{
+		Keg:      *f.keg,
+		Pin:      &pin,
+		Contents: f.Contents,
+		Beer:     f.beer,
+		Poured:   f.TotalFlow(),
+	}
+}
+
+func (s StoredKeg) info() KegInfo {
+	var poured float64
+	for _, volume := range s.Poured {
+		poured += volume.Volume
+	}
+	return KegInfo{
+		Keg:      *s.Keg,
+		Contents: s.Contents,
+		Beer:     s.Beer,
+		Poured:   poured,
+	}
+}
+
+// ListKegs describes every known keg, tapped kegs first
+func (s *State) ListKegs() []KegInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kegs := make([]KegInfo, 0, len(s.Kegs)+len(s.Cellar))
+	for _, flow := range s.Kegs {
+		flow.Lock()
+		kegs = append(kegs, flow.kegInfo())
+		flow.Unlock()
+	}
+	for _, stored := range s.Cellar {
+		kegs = append(kegs, stored.info())
+	}
+	return kegs
+}
+
+// FindKeg describes the keg with the provided ID
+func (s *State) FindKeg(id string) (KegInfo, bool) {
+	for _, keg := range s.ListKegs() {
+		if keg.ID == id {
+			return keg, true
+		}
+	}
+	return KegInfo{}, false
+}
+
+// TapKeg moves the keg with the provided ID onto the flow meter attached to
+// pin. The keg previously on that flow meter is stored, or swapped onto the
+// moved keg's previous flow meter if it was tapped
+func (s *State) TapKeg(id string, pin int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var target, source *Flow
+	for _, flow := range s.Kegs {
+		if flow.pinNumber == pin {
+			target = flow
+		}
+		flow.Lock()
+		if flow.keg.ID == id {
+			source = flow
+		}
+		flow.Unlock()
+	}
+	if target == nil {
+		return fmt.Errorf("no keg found on pin %d", pin)
+	}
+	if source == target {
+		return nil
+	}
+
+	if source != nil {
+		// flows are only locked in pairs while holding the state's lock, so
+		// the order that they are locked in does not matter
+		source.Lock()
+		target.Lock()
+		moved, replaced := source.untap(), target.untap()
+		target.tap(moved)
+		source.tap(replaced)
+		target.Unlock()
+		source.Unlock()
+		return nil
+	}
+
+	for i, stored := range s.Cellar {
+		if stored.Keg.ID != id {
+			continue
+		}
+		if stored.Keg.State == KegStateCleaned {
+			return fmt.Errorf("keg %s is empty", id)
+		}
+
+		target.Lock()
+		s.Cellar[i] = target.untap()
+		target.tap(stored)
+		target.Unlock()
+		return nil
+	}
+	return fmt.Errorf("no keg found with id %q", id)
+}
+
+// CleanKeg marks a kicked keg as cleaned. A tapped keg stays on its flow meter
+// until it is replaced
+func (s *State) CleanKeg(id string) error {
+	return s.updateKeg(id, func(keg *Keg, now time.Time) error {
+		return keg.transition(KegStateCleaned, now)
+	})
+}
+
+// FillKeg marks a stored, cleaned keg as filled with new contents
+func (s *State) FillKeg(id, contents string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, stored := range s.Cellar {
+		if stored.Keg.ID != id {
+			continue
+		}
+		err := stored.Keg.transition(KegStateFilled, s.now())
+		if err != nil {
+			return err
+		}
+		s.Cellar[i].Contents = contents
+		s.Cellar[i].Beer = nil
+		s.Cellar[i].Poured = nil
+		return nil
+	}
+
+	for _, flow := range s.Kegs {
+		if flow.keg.ID == id {
+			return fmt.Errorf("keg %s is tapped on %d, refill it instead", id, flow.pinNumber)
+		}
+	}
+	return fmt.Errorf("no keg found with id %q", id)
+}
+
+// RemoveKeg removes a stored keg from the cellar, such as one that has been
+// returned or sold. Tapped kegs must be replaced before they can be removed
+func (s *State) RemoveKeg(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, stored := range s.Cellar {
+		if stored.Keg.ID == id {
+			s.Cellar = append(s.Cellar[:i], s.Cellar[i+1:]...)
+			return nil
+		}
+	}
+
+	for _, flow := range s.Kegs {
+		if flow.keg.ID == id {
+			return fmt.Errorf("keg %s is tapped on %d, replace it first", id, flow.pinNumber)
+		}
+	}
+	return fmt.Errorf("no keg found with id %q", id)
+}
+
+// updateKeg applies fn to the keg with the provided ID
+func (s *State) updateKeg(id string, fn func(*Keg, time.Time) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, flow := range s.Kegs {
+		if flow.keg.ID != id {
+			continue
+		}
+		flow.Lock()
+		defer flow.Unlock()
+		return fn(flow.keg, flow.clock.Now())
+	}
+	for _, stored := range s.Cellar {
+		if stored.Keg.ID == id {
+			return fn(stored.Keg, s.now())
+		}
+	}
+	return fmt.Errorf("no keg found with id %q", id)
+}
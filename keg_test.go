@@ -0,0 +1,69 @@
+package kegerator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTapKegEndsPours(t *testing.T) {
+	tests := []struct {
+		name   string
+		pulses int
+		event  string
+	}{
+		{"counted", defaultPourEventThreshold, EventPourFinished},
+		{"below threshold", defaultPourEventThreshold - 1, EventPourDiscarded},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flow, clock, sub := newTestFlow(t)
+			flow.keg.ID = "outgoing"
+			stored := KegCorny
+			stored.ID = "incoming"
+			state := &State{
+				clock:  clock,
+				Kegs:   []*Flow{flow},
+				Cellar: []StoredKeg{{Keg: &stored, Contents: "stout"}},
+			}
+
+			// the pour in progress is ended as its keg is untapped, so that
+			// pulses after the swap start a pour from the incoming keg
+			last := pour(flow, clock, test.pulses, 50*time.Millisecond)
+			err := state.TapKeg("incoming", 17)
+			if err != nil {
+				t.Fatalf("tap keg: %s", err)
+			}
+			clock.Set(last.Add(50 * time.Millisecond))
+			pour(flow, clock, defaultPourEventThreshold, 50*time.Millisecond)
+			clock.Advance(defaultDeltaThreshold)
+
+			var ended []string
+			for _, event := range eventTypes(sub) {
+				if event == EventPourFinished || event == EventPourDiscarded {
+					ended = append(ended, event)
+				}
+			}
+			if len(ended) != 2 || ended[0] != test.event || ended[1] != EventPourFinished {
+				t.Errorf("ended = %v, want %s then %s", ended, test.event, EventPourFinished)
+			}
+
+			flow.Lock()
+			defer flow.Unlock()
+			if len(flow.Pours) == 0 || flow.keg.ID != "incoming" {
+				t.Fatalf("tapped %q with %d pours, want incoming with a pour", flow.keg.ID, len(flow.Pours))
+			}
+			if latest := flow.Pours[len(flow.Pours)-1]; latest.keg != "incoming" || latest.events != defaultPourEventThreshold {
+				t.Errorf("latest pour = %+v, want %d events from incoming keg", latest, defaultPourEventThreshold)
+			}
+
+			outgoing := state.Cellar[0].info()
+			if test.event == EventPourFinished && outgoing.Poured == 0 {
+				t.Errorf("outgoing keg poured nothing, want the finished pour")
+			}
+			if test.event == EventPourDiscarded && outgoing.Poured != 0 {
+				t.Errorf("outgoing keg poured %f, want nothing", outgoing.Poured)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package kegerator
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	// kick detection only considers pours once the keg is nearly empty, as
+	// measured by the current flow constant
+	defaultKickRemaining = 0.2 // fraction of keg volume
+
+	// foam and air cause the flow meter to sputter, producing pulse intervals
+	// that vary far more than those of a steady pour
+	defaultKickVariation = 0.75 // coefficient of variation of pulse intervals
+	defaultKickPulses    = 30   // pulses in a pour before variation is considered
+)
+
+// KickProposal is a flow constant derived from the pulses counted between
+// refilling a keg and the keg being kicked
+type KickProposal struct {
+	CalibrationRecord
+	Applied bool `json:"applied"`
+}
+
+// kickDetector tracks the variation of pulse intervals during a pour
+type kickDetector struct {
+	count int
+	mean  float64 // seconds
+	m2    float64 // sum of squared differences from the mean
+}
+
+// add includes the interval between two pulses
+func (d *kickDetector) add(interval time.Duration) {
+	d.count++
+	delta := interval.Seconds() - d.mean
+	d.mean += delta / float64(d.count)
+	d.m2 += delta * (interval.Seconds() - d.mean)
+}
+
+func (d *kickDetector) reset() {
+	*d = kickDetector{}
+}
+
+// foamy reports whether enough pulses have been seen and their intervals vary
+// enough to indicate foam or air passing through the flow meter
+func (d *kickDetector) foamy() bool {
+	if d.count < defaultKickPulses || d.mean <= 0 {
+		return false
+	}
+	stddev := math.Sqrt(d.m2 / float64(d.count-1))
+	return stddev/d.mean > defaultKickVariation
+}
+
+// Kick marks the keg as empty and proposes a flow constant such that the
+// pulses counted since the last refill would have measured the keg's full
+// volume. If automatic calibration is enabled, the proposal is also applied
+func (f *Flow) Kick() (KickProposal, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.kick()
+}
+
+// kick must be called while holding the flow's lock
+func (f *Flow) kick() (KickProposal, error) {
+	// a keg that has been cleaned while still tapped cannot be kicked again
+	err := f.keg.transition(KegStateKicked, f.clock.Now())
+	if err != nil {
+		return KickProposal{}, err
+	}
+	f.kicked = true
+
+	estimated := f.TotalFlow()
+	if f.keg.Volume <= 0 {
+		err = fmt.Errorf("unknown keg volume")
+	} else if f.partial {
+		err = fmt.Errorf("keg was poured from before it was tapped")
+	} else if f.pulseTotal <= 0 || estimated <= 0 {
+		err = fmt.Errorf("no pulses counted since refill")
+	}
+	if err != nil {
+		f.publish(KegKicked{
+			Time: f.clock.Now(),
+			Pin:  f.pinNumber,
+		})
+		return KickProposal{}, err
+	}
+
+	// the volume measured by a calibration curve does not follow from the
+	// flow constant, so the constant is scaled by the same ratio as the curve
+	flowConstant := float64(f.pulseTotal) / (f.keg.Volume * 60.0)
+	if len(f.sensor.Calibration) > 0 {
+		flowConstant = f.sensor.FlowConstant * estimated / f.keg.Volume
+	}
+	f.proposal = &KickProposal{
+		CalibrationRecord: CalibrationRecord{
+			Method:           CalibrationMethodKick,
+			Time:             f.clock.Now(),
+			Pulses:           f.pulseTotal,
+			Estimated:        estimated,
+			Measured:         f.keg.Volume,
+			Error:            (estimated - f.keg.Volume) / f.keg.Volume,
+			PreviousConstant: f.sensor.FlowConstant,
+			FlowConstant:     flowConstant,
+		},
+	}
+	if f.autoCalibrate {
+		f.applyProposal()
+	}
+
+	// subscribers encode events without holding the flow's lock, so they are
+	// given a copy of the proposal rather than the one that may be applied
+	proposal := *f.proposal
+	published := proposal
+	f.publish(KegKicked{
+		Time:     proposal.Time,
+		Pin:      f.pinNumber,
+		Proposal: &published,
+	})
+	return proposal, nil
+}
+
+// Kicked reports whether the keg has been kicked since the last refill
+func (f *Flow) Kicked() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.kicked
+}
+
+// Proposal returns the flow constant proposed when the keg was last kicked, if
+// it has not yet been applied
+func (f *Flow) Proposal() (KickProposal, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.proposal == nil || f.proposal.Applied {
+		return KickProposal{}, false
+	}
+	return *f.proposal, true
+}
+
+// ApplyProposal sets the flow constant proposed when the keg was last kicked
+// and appends it to the flow meter's calibration history
+func (f *Flow) ApplyProposal() (KickProposal, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.proposal == nil || f.proposal.Applied {
+		return KickProposal{}, fmt.Errorf("no proposed flow constant")
+	}
+	f.applyProposal()
+	return *f.proposal, nil
+}
+
+// applyProposal must be called while holding the flow's lock
+func (f *Flow) applyProposal() {
+	// the flow constant may have changed since the proposal was made
+	f.proposal.PreviousConstant = f.sensor.FlowConstant
+	record := f.proposal.CalibrationRecord
+	f.applyCalibration(record, record.Measured/record.Estimated)
+	f.proposal.Applied = true
+	log.Printf(
+		"Calibrated %d from kicked keg: flow constant %.2f -> %.2f, error %.2f%%\n",
+		f.pinNumber,
+		record.PreviousConstant,
+		record.FlowConstant,
+		record.Error*100,
+	)
+}
+
+// SetAutoCalibrate sets whether flow constants proposed when the keg is kicked
+// are applied automatically
+func (f *Flow) SetAutoCalibrate(auto bool) {
+	f.mu.Lock()
+	f.autoCalibrate = auto
+	f.mu.Unlock()
+}
+
+// detectKick checks the current pour for foam or air once the keg is nearly
+// empty. It must be called while holding the flow's lock
+func (f *Flow) detectKick() {
+	if f.kicked || f.RemainingVolume() > f.keg.Volume*defaultKickRemaining {
+		return
+	}
+	// only kegs being served from can be kicked, so a cleaned keg left on the
+	// tap is not detected on every pulse
+	switch f.keg.State {
+	case "", KegStateTapped, KegStateServing:
+	default:
+		return
+	}
+	if !f.foam.foamy() {
+		return
+	}
+
+	log.Printf("Detected kicked keg on %d\n", f.pinNumber)
+	proposal, err := f.kick()
+	if err != nil {
+		log.Printf("WARN: pin %d: propose flow constant: %s\n", f.pinNumber, err)
+		return
+	}
+	if !proposal.Applied {
+		log.Printf(
+			"Proposed flow constant %.2f for %d, error %.2f%%\n",
+			proposal.FlowConstant,
+			f.pinNumber,
+			proposal.Error*100,
+		)
+	}
+}
@@ -0,0 +1,67 @@
+package kegerator
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// foamyPour sends pulses with widely varying intervals, as when a keg is kicked
+func foamyPour(flow *Flow, clock *ManualClock) {
+	t := clock.Now()
+	for i := 0; i < 2*defaultKickPulses; i++ {
+		interval := 10 * time.Millisecond
+		if i%2 == 1 {
+			interval = 400 * time.Millisecond
+		}
+		t = t.Add(interval)
+		clock.Set(t)
+		flow.Update(t.UnixMicro())
+	}
+}
+
+func TestDetectKick(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+
+	tests := []struct {
+		state  string
+		kicked bool
+	}{
+		{KegStateServing, true},
+		{KegStateCleaned, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.state, func(t *testing.T) {
+			logged.Reset()
+			flow, clock, sub := newTestFlow(t)
+			flow.Lock()
+			flow.keg.State = test.state
+			flow.setDispensed([]PouredVolume{{
+				FlowConstant: flow.sensor.FlowConstant,
+				Volume:       flow.keg.Volume * 0.9,
+			}})
+			flow.Unlock()
+
+			foamyPour(flow, clock)
+			foamyPour(flow, clock)
+
+			var kicks int
+			for _, event := range eventTypes(sub) {
+				if event == EventKegKicked {
+					kicks++
+				}
+			}
+			if test.kicked != flow.Kicked() || (test.kicked && kicks != 1) || (!test.kicked && kicks != 0) {
+				t.Errorf("kicked = %t with %d events, want %t", flow.Kicked(), kicks, test.kicked)
+			}
+			if strings.Contains(logged.String(), "cannot move") {
+				t.Errorf("logged transition error: %s", logged.String())
+			}
+		})
+	}
+}
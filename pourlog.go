@@ -0,0 +1,141 @@
+package kegerator
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+const (
+	DefaultPourLogSize   = 1 << 20              // bytes written before the log is rotated
+	DefaultPourRetention = 365 * 24 * time.Hour // age at which rotated logs are removed
+
+	defaultPourLogBuffer = 1024 // finished pours buffered before being written
+)
+
+// GlobalPourLog records finished pours to disk. If it is nil, pours are only
+// served from memory
+var GlobalPourLog *PourLog
+
+// PourLog appends finished pours to pours.jsonl in its directory
+type PourLog struct {
+	log  *jsonLog
+	sub  *Subscription
+	done chan struct{}
+}
+
+// NewPourLog opens the pour log in dir, creating the directory if necessary.
+// The log is rotated once it exceeds maxSize bytes, and rotated logs are
+// removed once they are older than retention, unless retention is zero
+func NewPourLog(dir string, maxSize int64, retention time.Duration, clock Clock) (*PourLog, error) {
+	l, err := openJSONLog(dir, "pours", maxSize, retention, clock)
+	if err != nil {
+		return nil, err
+	}
+	return &PourLog{log: l}, nil
+}
+
+// Start appends every pour finished on the provided bus to the log
+func (l *PourLog) Start(bus *EventBus) {
+	if l.sub != nil {
+		return
+	}
+
+	l.sub = bus.Subscribe(defaultPourLogBuffer)
+	l.done = make(chan struct{})
+	go func() {
+		defer close(l.done)
+		for event := range l.sub.Events() {
+			finished, ok := event.(PourFinished)
+			if !ok {
+				continue
+			}
+
+			err := l.Append(finished.PourEvent)
+			if err != nil {
+				log.Println("ERR: append pour log:", err)
+			}
+		}
+	}()
+}
+
+// loggedPour is a pour event as written to the log. Start times are logged to
+// the nanosecond, so that logged pours keep the order and cursors of the pours
+// in memory
+type loggedPour struct {
+	Pin      int      `json:"pin"`
+	Contents string   `json:"contents"`
+	Pour     pourJSON `json:"pour"`
+}
+
+// Append writes a pour to the log
+func (l *PourLog) Append(pour PourEvent) error {
+	return l.log.append(loggedPour{
+		Pin:      pour.Pin,
+		Contents: pour.Contents,
+		Pour:     pour.Pour.encode(time.RFC3339Nano),
+	})
+}
+
+// Query returns a page of the pours in the log within the retention period
+// that match the query, along with a cursor for the next page, if any
+func (l *PourLog) Query(query PourQuery) ([]PourEvent, string, error) {
+	pours, err := l.match(query)
+	if err != nil {
+		return nil, "", err
+	}
+	return query.Apply(pours)
+}
+
+// match returns every pour in the log within the retention period that matches
+// the query's filters, oldest first
+func (l *PourLog) match(query PourQuery) ([]PourEvent, error) {
+	var pours []PourEvent
+	err := l.Each(query, func(pour PourEvent) error {
+		pours = append(pours, pour)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pours, nil
+}
+
+// Each calls fn with every pour in the log within the retention period that
+// matches the query's filters, in the order that they were logged. Reading
+// stops at the first error returned by fn, which is returned
+func (l *PourLog) Each(query PourQuery, fn func(PourEvent) error) error {
+	cutoff := l.log.cutoff()
+
+	var fnErr error
+	err := l.log.read(query.From, func(data []byte) error {
+		var pour PourEvent
+		err := json.Unmarshal(data, &pour)
+		if err != nil {
+			return err
+		}
+		if pour.Pour.StartTime.Before(cutoff) || !query.Match(pour) {
+			return nil
+		}
+
+		fnErr = fn(pour)
+		if fnErr != nil {
+			return errStopRead
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// Close stops appending pours from the event bus, writing any that are
+// buffered, and closes the log
+func (l *PourLog) Close() error {
+	if l.sub != nil {
+		l.sub.Close()
+		<-l.done
+	}
+	return l.log.close()
+}
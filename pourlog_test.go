@@ -0,0 +1,90 @@
+package kegerator
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestPourLog(t *testing.T) {
+	flow, clock, _ := newTestFlow(t)
+	dir := t.TempDir()
+	l, err := NewPourLog(dir, 1<<20, 0, clock)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	l.Start(flow.bus)
+
+	// only finished pours are logged, with their start times to the
+	// nanosecond
+	for i, pulses := range []int{defaultPourEventThreshold, defaultPourEventThreshold - 1, 2 * defaultPourEventThreshold} {
+		clock.Set(testStart.Add(time.Duration(i)*time.Minute + 250*time.Millisecond))
+		pour(flow, clock, pulses, 50*time.Millisecond)
+	}
+	clock.Advance(time.Minute)
+
+	err = l.Close()
+	if err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	// pours are read back after the log is reopened
+	l, err = NewPourLog(dir, 1<<20, 0, clock)
+	if err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+	defer l.Close()
+
+	logged, _, err := l.Query(PourQuery{Order: OrderAscending})
+	if err != nil {
+		t.Fatalf("query: %s", err)
+	}
+	flow.Lock()
+	defer flow.Unlock()
+	if len(logged) != len(flow.Pours) {
+		t.Fatalf("logged %d pours, want %d", len(logged), len(flow.Pours))
+	}
+	for i, event := range logged {
+		want := flow.Pours[i]
+		if event.Pin != 17 || event.Contents != "ipa" || !event.Pour.StartTime.Equal(want.StartTime) || event.Pour.Volume != want.Volume {
+			t.Errorf("pour %d = %+v, want %+v", i, event, want)
+		}
+	}
+
+	// but are served with RFC3339 start times
+	data, err := json.Marshal(logged[0].Pour)
+	if err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+	var served struct {
+		Time string `json:"time"`
+	}
+	err = json.Unmarshal(data, &served)
+	if err != nil || served.Time != testStart.Format(time.RFC3339) {
+		t.Errorf("time = %q (%v), want %q", served.Time, err, testStart.Format(time.RFC3339))
+	}
+}
+
+func TestPourLogRetention(t *testing.T) {
+	clock := NewManualClock(testStart)
+	l, err := NewPourLog(t.TempDir(), 1<<20, time.Hour, clock)
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer l.Close()
+
+	for _, age := range []time.Duration{2 * time.Hour, 30 * time.Minute} {
+		err = l.Append(PourEvent{Pin: 17, Pour: Pour{StartTime: testStart.Add(-age), Volume: 0.5}})
+		if err != nil {
+			t.Fatalf("append: %s", err)
+		}
+	}
+
+	logged, _, err := l.Query(PourQuery{Order: OrderAscending})
+	if err != nil {
+		t.Fatalf("query: %s", err)
+	}
+	if len(logged) != 1 || !logged[0].Pour.StartTime.Equal(testStart.Add(-30*time.Minute)) {
+		t.Errorf("pours = %+v, want only the pour within the retention period", logged)
+	}
+}
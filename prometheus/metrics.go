@@ -12,7 +12,11 @@ var (
 	PourVolume          *prometheus.CounterVec
 	HTTPRequestDuration *prometheus.CounterVec
 	DHTRetries          *prometheus.CounterVec
+	FlowDroppedEdges    *prometheus.CounterVec
+	FlowCoalescedPulses *prometheus.CounterVec
+	FlowRejectedPulses  *prometheus.CounterVec
 	RemainingVolume     *prometheus.GaugeVec
+	KegEmptyETA         *prometheus.GaugeVec
 	DHTTemperature      *prometheus.GaugeVec
 	DHTHumidity         *prometheus.GaugeVec
 )
@@ -47,6 +51,33 @@ func BuildMetrics() *prometheus.Registry {
 		[]string{"pin", "sensor"},
 	)
 
+	FlowDroppedEdges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "flow_dropped_edges_total",
+			Help:      "Number of flow meter edges dropped before being read from the kernel",
+		},
+		[]string{"pin"},
+	)
+
+	FlowCoalescedPulses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "flow_coalesced_pulses_total",
+			Help:      "Number of flow meter pulses received while the pulse buffer was full",
+		},
+		[]string{"pin"},
+	)
+
+	FlowRejectedPulses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "flow_rejected_pulses_total",
+			Help:      "Number of flow meter pulses rejected as glitches",
+		},
+		[]string{"pin"},
+	)
+
 	RemainingVolume = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: namespace,
@@ -56,6 +87,15 @@ func BuildMetrics() *prometheus.Registry {
 		[]string{"pin", "type", "contents"},
 	)
 
+	KegEmptyETA = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "keg_empty_eta_seconds",
+			Help:      "Estimated time until a given keg runs out, if it is forecast to",
+		},
+		[]string{"pin", "type", "contents"},
+	)
+
 	DHTTemperature = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: namespace,
@@ -77,10 +117,14 @@ func BuildMetrics() *prometheus.Registry {
 	metrics := []prometheus.Collector{
 		PourVolume,
 		RemainingVolume,
+		KegEmptyETA,
 		HTTPRequestDuration,
 		DHTTemperature,
 		DHTHumidity,
 		DHTRetries,
+		FlowDroppedEdges,
+		FlowCoalescedPulses,
+		FlowRejectedPulses,
 	}
 
 	for _, metric := range metrics {
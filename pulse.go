@@ -0,0 +1,216 @@
+package kegerator
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/subtlepseudonym/kegerator/prometheus"
+
+	"github.com/warthog618/gpiod"
+	"golang.org/x/sys/unix"
+)
+
+// PulseSource provides flow meter pulses to a Flow
+//
+// Once opened, each pulse is passed to the handler as a timestamp in
+// microseconds. Handlers are called serially
+type PulseSource interface {
+	Open(handler func(int64)) error
+	Close() error
+}
+
+// GPIOPulseSource reads flow meter pulses from a gpio line
+//
+// Pulses are timestamped by the kernel when the edge is detected, rather than
+// when the event is read. Gaps in event sequence numbers indicate edges that
+// were dropped by the kernel and are reported as a metric
+type GPIOPulseSource struct {
+	pin    int
+	config LineConfig
+	line   *gpiod.Line
+	clock  eventClock
+	seqno  seqnoCounter
+}
+
+// NewGPIOPulseSource initializes a pulse source for the given line offset.
+// The line is requested according to the provided configuration
+func NewGPIOPulseSource(pin int, config LineConfig) *GPIOPulseSource {
+	return &GPIOPulseSource{
+		pin:    pin,
+		config: config,
+		seqno:  seqnoCounter{pin: pin},
+	}
+}
+
+// Open requests the gpio line for input and begins watching it for events
+//
+// If a debounce period is configured but the kernel does not support
+// debouncing, the line is requested without it. Flows apply the debounce
+// period in software regardless
+func (s *GPIOPulseSource) Open(handler func(int64)) error {
+	eventHandler := gpiod.WithEventHandler(func(evt gpiod.LineEvent) {
+		s.seqno.check(evt.LineSeqno)
+		handler(s.clock.micro(evt.Timestamp))
+	})
+
+	err := s.request(eventHandler, true)
+	if err != nil && s.config.DebouncePeriod() > 0 {
+		log.Printf("WARN: pin %d: kernel debounce unavailable: %s\n", s.pin, err)
+		err = s.request(eventHandler, false)
+	}
+	if err != nil {
+		return fmt.Errorf("request %s pin %d failed: %w", s.config.chip(), s.pin, err)
+	}
+
+	return nil
+}
+
+func (s *GPIOPulseSource) request(eventHandler gpiod.EventHandler, debounce bool) error {
+	options := []gpiod.LineReqOption{
+		gpiod.AsInput,
+		eventHandler,
+	}
+	for _, option := range s.config.options(debounce) {
+		options = append(options, option)
+	}
+
+	return requestWithEventClock(
+		&s.clock,
+		func(options ...gpiod.LineReqOption) error {
+			var err error
+			s.line, err = gpiod.RequestLine(s.config.chip(), s.pin, options...)
+			return err
+		},
+		options...,
+	)
+}
+
+// Close releases the gpio line
+func (s *GPIOPulseSource) Close() error {
+	if s.line == nil {
+		return nil
+	}
+	return s.line.Close()
+}
+
+// eventClock converts kernel event timestamps into wall time
+type eventClock struct {
+	realtime bool      // event timestamps are from CLOCK_REALTIME
+	bootTime time.Time // wall time corresponding to CLOCK_MONOTONIC zero
+}
+
+// micro returns the timestamp in microseconds since the unix epoch
+func (c eventClock) micro(timestamp time.Duration) int64 {
+	if c.realtime {
+		return timestamp.Microseconds()
+	}
+	return c.bootTime.Add(timestamp).UnixMicro()
+}
+
+// requestWithEventClock calls request with the provided options, asking for
+// event timestamps from CLOCK_REALTIME. This requires Linux v5.11 or later, so
+// on failure the request is retried with timestamps from CLOCK_MONOTONIC, which
+// are converted to wall time. The clock is configured before each request is
+// made, so it is safe to use from the event handler
+func requestWithEventClock(clock *eventClock, request func(...gpiod.LineReqOption) error, options ...gpiod.LineReqOption) error {
+	clock.realtime = true
+	// the event clock must precede any per-line options, which copy the
+	// default configuration when applied
+	realtimeOptions := append([]gpiod.LineReqOption{gpiod.WithRealtimeEventClock}, options...)
+	err := request(realtimeOptions...)
+	if err == nil {
+		return nil
+	}
+
+	clock.realtime = false
+	clock.bootTime, err = bootTime()
+	if err != nil {
+		return err
+	}
+	return request(options...)
+}
+
+// bootTime returns the wall time at which CLOCK_MONOTONIC was zero
+func bootTime() (time.Time, error) {
+	var ts unix.Timespec
+	err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("get monotonic time: %w", err)
+	}
+	return time.Now().Add(-time.Duration(ts.Nano())), nil
+}
+
+// seqnoCounter tracks line event sequence numbers in order to detect edges
+// dropped by the kernel
+type seqnoCounter struct {
+	pin  int
+	last uint32
+}
+
+// check records any edges skipped since the previous event. Sequence numbers
+// are always zero when using uAPI v1, in which case dropped edges cannot be
+// detected
+func (c *seqnoCounter) check(seqno uint32) {
+	if seqno == 0 {
+		return
+	}
+
+	if c.last != 0 && seqno > c.last+1 {
+		dropped := seqno - c.last - 1
+		prometheus.FlowDroppedEdges.WithLabelValues(strconv.Itoa(c.pin)).Add(float64(dropped))
+		log.Printf("WARN: pin %d: dropped %d edges\n", c.pin, dropped)
+	}
+	c.last = seqno
+}
+
+// MemoryPulseSource delivers pulses provided by the caller rather than by
+// hardware. This is useful for running flow logic without a flow meter attached
+type MemoryPulseSource struct {
+	mu      sync.Mutex
+	handler func(int64)
+}
+
+// NewMemoryPulseSource initializes an unopened in-memory pulse source
+func NewMemoryPulseSource() *MemoryPulseSource {
+	return &MemoryPulseSource{}
+}
+
+func (s *MemoryPulseSource) Open(handler func(int64)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.handler != nil {
+		return fmt.Errorf("pulse source already open")
+	}
+	s.handler = handler
+	return nil
+}
+
+func (s *MemoryPulseSource) Close() error {
+	s.mu.Lock()
+	s.handler = nil
+	s.mu.Unlock()
+	return nil
+}
+
+// Pulse delivers a single pulse with the given timestamp, in microseconds.
+// Pulses sent to a closed source are discarded
+func (s *MemoryPulseSource) Pulse(event int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.handler == nil {
+		return
+	}
+	s.handler(event)
+}
+
+// Train delivers count pulses, evenly spaced by interval, beginning at start
+func (s *MemoryPulseSource) Train(start time.Time, interval time.Duration, count int) {
+	for i := 0; i < count; i++ {
+		s.Pulse(start.Add(time.Duration(i) * interval).UnixMicro())
+	}
+}
@@ -0,0 +1,269 @@
+package kegerator
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pour query sort orders
+const (
+	OrderAscending  = "asc"
+	OrderDescending = "desc"
+)
+
+// PourQuery selects pours by time, keg and volume. Zero values are unbounded.
+// Pours are ordered by start time, then by pin
+type PourQuery struct {
+	From      time.Time // inclusive
+	To        time.Time // exclusive
+	Pin       *int
+	Keg       string
+	Contents  string
+	MinVolume float64
+	MaxVolume float64
+	Order     string
+	Limit     int
+	Cursor    string // from a previous page of results
+}
+
+// ParsePourQuery reads a query from url query params: from, to, pin, keg,
+// contents, min_volume, max_volume, order, limit and cursor. Times are RFC3339.
+// The cursor is checked here so that a query that parses can only fail to run
+// if the pour log cannot be read
+func ParsePourQuery(values url.Values) (PourQuery, error) {
+	query := PourQuery{
+		Keg:      values.Get("keg"),
+		Contents: values.Get("contents"),
+		Order:    OrderDescending,
+		Limit:    defaultPourLimit,
+		Cursor:   values.Get("cursor"),
+	}
+
+	var err error
+	for param, t := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if values.Get(param) == "" {
+			continue
+		}
+		*t, err = time.Parse(time.RFC3339, values.Get(param))
+		if err != nil {
+			return PourQuery{}, fmt.Errorf("bad %s value: %w", param, err)
+		}
+	}
+
+	for param, volume := range map[string]*float64{"min_volume": &query.MinVolume, "max_volume": &query.MaxVolume} {
+		if values.Get(param) == "" {
+			continue
+		}
+		*volume, err = strconv.ParseFloat(values.Get(param), 64)
+		if err != nil {
+			return PourQuery{}, fmt.Errorf("bad %s value: %w", param, err)
+		}
+	}
+
+	if values.Get("pin") != "" {
+		pin, err := strconv.Atoi(values.Get("pin"))
+		if err != nil {
+			return PourQuery{}, fmt.Errorf("bad pin value: %w", err)
+		}
+		query.Pin = &pin
+	}
+
+	if values.Get("limit") != "" {
+		query.Limit, err = strconv.Atoi(values.Get("limit"))
+		if err != nil {
+			return PourQuery{}, fmt.Errorf("bad limit value: %w", err)
+		}
+		if query.Limit <= 0 {
+			return PourQuery{}, fmt.Errorf("non-positive limit %d", query.Limit)
+		}
+	}
+
+	switch values.Get("order") {
+	case "":
+	case OrderAscending, OrderDescending:
+		query.Order = values.Get("order")
+	default:
+		return PourQuery{}, fmt.Errorf("unknown order %q", values.Get("order"))
+	}
+
+	if query.Cursor != "" {
+		_, err = decodePourCursor(query.Cursor)
+		if err != nil {
+			return PourQuery{}, err
+		}
+	}
+
+	return query, nil
+}
+
+// Match reports whether a pour satisfies the query's filters
+func (q PourQuery) Match(pour PourEvent) bool {
+	switch {
+	case !q.From.IsZero() && pour.Pour.StartTime.Before(q.From):
+		return false
+	case !q.To.IsZero() && !pour.Pour.StartTime.Before(q.To):
+		return false
+	case q.Pin != nil && pour.Pin != *q.Pin:
+		return false
+	case q.Keg != "" && pour.Pour.keg != q.Keg:
+		return false
+	case q.Contents != "" && pour.Contents != q.Contents:
+		return false
+	case q.MinVolume > 0 && pour.Pour.Volume < q.MinVolume:
+		return false
+	case q.MaxVolume > 0 && pour.Pour.Volume > q.MaxVolume:
+		return false
+	}
+	return true
+}
+
+// Apply filters and orders pours, returning a single page of results. If more
+// results remain, a cursor for the next page is also returned
+func (q PourQuery) Apply(pours []PourEvent) ([]PourEvent, string, error) {
+	var after *pourKey
+	if q.Cursor != "" {
+		key, err := decodePourCursor(q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		after = &key
+	}
+
+	descending := q.Order == OrderDescending
+	var matched []PourEvent
+	for _, pour := range pours {
+		if !q.Match(pour) {
+			continue
+		}
+		if after != nil && !after.before(keyOf(pour), descending) {
+			continue
+		}
+		matched = append(matched, pour)
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		return keyOf(matched[i]).before(keyOf(matched[j]), descending)
+	})
+
+	if q.Limit <= 0 || len(matched) <= q.Limit {
+		return matched, "", nil
+	}
+	matched = matched[:q.Limit]
+	return matched, keyOf(matched[len(matched)-1]).cursor(), nil
+}
+
+// pourKey identifies a pour's position in query results. A keg cannot start
+// two pours at the same time, so the key is unique
+type pourKey struct {
+	time int64 // unix nanoseconds
+	pin  int
+}
+
+func keyOf(pour PourEvent) pourKey {
+	return pourKey{
+		time: pour.Pour.StartTime.UnixNano(),
+		pin:  pour.Pin,
+	}
+}
+
+// before reports whether k is ordered before other
+func (k pourKey) before(other pourKey, descending bool) bool {
+	if k == other {
+		return false
+	}
+	less := k.time < other.time || (k.time == other.time && k.pin < other.pin)
+	return less != descending
+}
+
+func (k pourKey) cursor() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", k.time, k.pin)))
+}
+
+func decodePourCursor(cursor string) (pourKey, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return pourKey{}, fmt.Errorf("bad cursor: %w", err)
+	}
+
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 {
+		return pourKey{}, fmt.Errorf("bad cursor")
+	}
+
+	var key pourKey
+	key.time, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return pourKey{}, fmt.Errorf("bad cursor: %w", err)
+	}
+	key.pin, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return pourKey{}, fmt.Errorf("bad cursor: %w", err)
+	}
+	return key, nil
+}
+
+// ReadingQuery selects DHT readings by time and sensor. Zero values are
+// unbounded. If more readings match than the limit, the most recent are kept
+type ReadingQuery struct {
+	From  time.Time // inclusive
+	To    time.Time // exclusive
+	Pin   *int
+	Limit int
+}
+
+// ParseReadingQuery reads a query from url query params: from, to, pin and
+// limit. Times are RFC3339
+func ParseReadingQuery(values url.Values) (ReadingQuery, error) {
+	query := ReadingQuery{
+		Limit: defaultReadingLimit,
+	}
+
+	var err error
+	for param, t := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if values.Get(param) == "" {
+			continue
+		}
+		*t, err = time.Parse(time.RFC3339, values.Get(param))
+		if err != nil {
+			return ReadingQuery{}, fmt.Errorf("bad %s value: %w", param, err)
+		}
+	}
+
+	if values.Get("pin") != "" {
+		pin, err := strconv.Atoi(values.Get("pin"))
+		if err != nil {
+			return ReadingQuery{}, fmt.Errorf("bad pin value: %w", err)
+		}
+		query.Pin = &pin
+	}
+
+	if values.Get("limit") != "" {
+		query.Limit, err = strconv.Atoi(values.Get("limit"))
+		if err != nil {
+			return ReadingQuery{}, fmt.Errorf("bad limit value: %w", err)
+		}
+		if query.Limit <= 0 {
+			return ReadingQuery{}, fmt.Errorf("non-positive limit %d", query.Limit)
+		}
+	}
+
+	return query, nil
+}
+
+// Match reports whether a reading satisfies the query's filters
+func (q ReadingQuery) Match(reading DHTReading) bool {
+	switch {
+	case !q.From.IsZero() && reading.Time.Before(q.From):
+		return false
+	case !q.To.IsZero() && !reading.Time.Before(q.To):
+		return false
+	case q.Pin != nil && reading.Pin != *q.Pin:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package kegerator
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testPours returns a pour each minute from testStart, alternating between
+// two taps
+func testPours(n int) []PourEvent {
+	pours := make([]PourEvent, n)
+	for i := range pours {
+		pin, contents := 17, "ipa"
+		if i%2 == 1 {
+			pin, contents = 27, "stout"
+		}
+		pours[i] = PourEvent{
+			Pin:      pin,
+			Contents: contents,
+			Pour: Pour{
+				StartTime: testStart.Add(time.Duration(i) * time.Minute),
+				Volume:    0.1 * float64(i+1),
+			},
+		}
+	}
+	return pours
+}
+
+func TestParsePourQuery(t *testing.T) {
+	query, err := ParsePourQuery(url.Values{
+		"from":       {"2023-04-03T18:00:00Z"},
+		"pin":        {"17"},
+		"min_volume": {"0.25"},
+		"order":      {"asc"},
+		"limit":      {"5"},
+	})
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	if !query.From.Equal(testStart) || query.Pin == nil || *query.Pin != 17 || query.MinVolume != 0.25 || query.Order != OrderAscending || query.Limit != 5 {
+		t.Errorf("query = %+v", query)
+	}
+
+	for _, values := range []url.Values{
+		{"from": {"yesterday"}},
+		{"pin": {"seventeen"}},
+		{"max_volume": {"lots"}},
+		{"limit": {"0"}},
+		{"order": {"random"}},
+	} {
+		if _, err := ParsePourQuery(values); err == nil {
+			t.Errorf("%v: expected error", values)
+		}
+	}
+}
+
+func TestPourQueryApply(t *testing.T) {
+	pours := testPours(10)
+	pin := 17
+	tests := []struct {
+		name  string
+		query PourQuery
+		want  []int // indexes into pours, in order
+	}{
+		{"all descending", PourQuery{Order: OrderDescending}, []int{9, 8, 7, 6, 5, 4, 3, 2, 1, 0}},
+		{"time range", PourQuery{From: pours[2].Pour.StartTime, To: pours[5].Pour.StartTime, Order: OrderAscending}, []int{2, 3, 4}},
+		{"pin", PourQuery{Pin: &pin, Order: OrderAscending}, []int{0, 2, 4, 6, 8}},
+		{"contents", PourQuery{Contents: "stout", Order: OrderAscending}, []int{1, 3, 5, 7, 9}},
+		{"volume", PourQuery{MinVolume: 0.35, MaxVolume: 0.65, Order: OrderAscending}, []int{3, 4, 5}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matched, cursor, err := test.query.Apply(pours)
+			if err != nil {
+				t.Fatalf("apply: %s", err)
+			}
+			if cursor != "" {
+				t.Errorf("cursor = %q, want none", cursor)
+			}
+			if len(matched) != len(test.want) {
+				t.Fatalf("matched %d pours, want %d", len(matched), len(test.want))
+			}
+			for i, idx := range test.want {
+				if !matched[i].Pour.StartTime.Equal(pours[idx].Pour.StartTime) {
+					t.Errorf("pour %d = %s, want %s", i, matched[i].Pour.StartTime, pours[idx].Pour.StartTime)
+				}
+			}
+		})
+	}
+}
+
+func TestPourQueryPagination(t *testing.T) {
+	pours := testPours(7)
+	for _, order := range []string{OrderAscending, OrderDescending} {
+		query := PourQuery{Order: order, Limit: 3}
+
+		// pages cover every pour exactly once, in order
+		var seen []time.Time
+		for page := 0; ; page++ {
+			if page > len(pours) {
+				t.Fatalf("%s: pagination did not end", order)
+			}
+			matched, cursor, err := query.Apply(pours)
+			if err != nil {
+				t.Fatalf("%s: apply: %s", order, err)
+			}
+			for _, pour := range matched {
+				seen = append(seen, pour.Pour.StartTime)
+			}
+			if cursor == "" {
+				break
+			}
+			query.Cursor = cursor
+		}
+
+		if len(seen) != len(pours) {
+			t.Fatalf("%s: saw %d pours, want %d", order, len(seen), len(pours))
+		}
+		for i := 1; i < len(seen); i++ {
+			if seen[i].Before(seen[i-1]) == (order == OrderAscending) {
+				t.Errorf("%s: pour %d at %s out of order", order, i, seen[i])
+			}
+		}
+	}
+
+	if _, _, err := (PourQuery{Cursor: "not a cursor"}).Apply(pours); err == nil {
+		t.Errorf("bad cursor: expected error")
+	}
+}
@@ -0,0 +1,137 @@
+package kegerator
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+const (
+	DefaultReadingLogSize   = 1 << 20             // bytes written before the log is rotated
+	DefaultReadingRetention = 90 * 24 * time.Hour // age at which rotated logs are removed
+	DefaultReadingInterval  = time.Minute         // minimum time between logged readings from a sensor
+
+	defaultReadingLogBuffer = 64 // readings buffered before being written
+)
+
+// GlobalReadingLog records DHT readings to disk. If it is nil, reading history
+// is unavailable
+var GlobalReadingLog *ReadingLog
+
+// ReadingLog appends DHT readings to readings.jsonl in its directory. Sensors
+// are read far more often than history needs, so readings arriving sooner than
+// the log's interval after the previous logged reading from the same sensor
+// are not logged
+type ReadingLog struct {
+	log      *jsonLog
+	interval time.Duration
+	last     map[int]time.Time // by pin, only accessed by the logging goroutine
+	sub      *Subscription
+	done     chan struct{}
+}
+
+// NewReadingLog opens the reading log in dir, creating the directory if
+// necessary. The log is rotated once it exceeds maxSize bytes, and rotated logs
+// are removed once they are older than retention, unless retention is zero
+func NewReadingLog(dir string, maxSize int64, retention, interval time.Duration, clock Clock) (*ReadingLog, error) {
+	l, err := openJSONLog(dir, "readings", maxSize, retention, clock)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReadingLog{
+		log:      l,
+		interval: interval,
+		last:     make(map[int]time.Time),
+	}, nil
+}
+
+// Start appends DHT readings published on the provided bus to the log
+func (l *ReadingLog) Start(bus *EventBus) {
+	if l.sub != nil {
+		return
+	}
+
+	l.sub = bus.Subscribe(defaultReadingLogBuffer)
+	l.done = make(chan struct{})
+	go func() {
+		defer close(l.done)
+		for event := range l.sub.Events() {
+			reading, ok := event.(DHTReading)
+			if !ok {
+				continue
+			}
+			if reading.Time.Sub(l.last[reading.Pin]) < l.interval {
+				continue
+			}
+
+			err := l.Append(reading)
+			if err != nil {
+				log.Println("ERR: append reading log:", err)
+				continue
+			}
+			l.last[reading.Pin] = reading.Time
+		}
+	}()
+}
+
+// Append writes a reading to the log
+func (l *ReadingLog) Append(reading DHTReading) error {
+	return l.log.append(reading)
+}
+
+// Query returns the readings in the log within the retention period that
+// match the query, oldest first. If more readings match than the query's
+// limit, only the most recent are returned
+func (l *ReadingLog) Query(query ReadingQuery) ([]DHTReading, error) {
+	var readings []DHTReading
+	err := l.Each(query, func(reading DHTReading) error {
+		readings = append(readings, reading)
+		if query.Limit > 0 && len(readings) > query.Limit {
+			readings = readings[1:]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return readings, nil
+}
+
+// Each passes the readings in the log within the retention period that match
+// the query to fn, oldest first, ignoring the query's limit. Reading stops at
+// the first error returned by fn, which is then returned
+func (l *ReadingLog) Each(query ReadingQuery, fn func(DHTReading) error) error {
+	cutoff := l.log.cutoff()
+
+	var fnErr error
+	err := l.log.read(query.From, func(data []byte) error {
+		var reading DHTReading
+		err := json.Unmarshal(data, &reading)
+		if err != nil {
+			return err
+		}
+		if reading.Time.Before(cutoff) || !query.Match(reading) {
+			return nil
+		}
+
+		fnErr = fn(reading)
+		if fnErr != nil {
+			return errStopRead
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// Close stops appending readings from the event bus and closes the log
+func (l *ReadingLog) Close() error {
+	if l.sub != nil {
+		l.sub.Close()
+		<-l.done
+	}
+	return l.log.close()
+}
@@ -0,0 +1,195 @@
+package kegerator
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// kegTypes are the reference kegs that may be requested by type when refilling
+var kegTypes = map[string]Keg{
+	KegCorny.Type:   KegCorny,
+	KegSixtel.Type:  KegSixtel,
+	KegQuarter.Type: KegQuarter,
+	KegHalf.Type:    KegHalf,
+}
+
+// Refill describes the keg put on tap when refilling a flow meter. Unset values
+// keep those of the tapped keg
+type Refill struct {
+	Keg       *Keg   // replaces the tapped keg, which is refilled in place if nil
+	Contents  string // defaults to the beer's name if the beer is set
+	Beer      *Beer
+	Remaining float64 // liters in the keg when tapped, or full if zero
+}
+
+// KegArchive records the totals of a keg as it was refilled or replaced
+type KegArchive struct {
+	Time             time.Time      `json:"time"`
+	Pin              int            `json:"pin"`
+	Keg              Keg            `json:"keg"`
+	Contents         string         `json:"contents"`
+	Beer             *Beer          `json:"beer,omitempty"`
+	Poured           float64        `json:"poured"`
+	PouredByConstant []PouredVolume `json:"poured_by_constant,omitempty"`
+	Pulses           int            `json:"pulses"`
+	RefilledWith     string         `json:"refilled_with"` // contents of the keg tapped in its place
+}
+
+// NewRefillKeg returns a keg to replace the tapped keg with, given its type,
+// ID and volume. Types other than the reference kegs require a volume. If the
+// type and volume are both unset, the keg matches the tapped keg. If all are
+// unset, nil is returned and the tapped keg is refilled in place
+func NewRefillKeg(kegType, id string, volume float64) (*Keg, error) {
+	if kegType == "" && id == "" && volume == 0 {
+		return nil, nil
+	}
+	if volume < 0 {
+		return nil, fmt.Errorf("negative keg volume %.2f", volume)
+	}
+
+	keg, ok := kegTypes[kegType]
+	if !ok {
+		if kegType != "" && volume == 0 {
+			return nil, fmt.Errorf("unknown keg type %q", kegType)
+		}
+		keg = Keg{Type: kegType}
+	}
+	keg.ID = id
+	if volume > 0 {
+		keg.Volume = volume
+	}
+	return &keg, nil
+}
+
+// Refill archives the totals of the tapped keg and then resets them, either
+// for the same keg refilled in place or for a new keg
+func (f *Flow) Refill(refill Refill) (KegArchive, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.refill(refill)
+}
+
+// refill must be called while holding the flow's lock
+func (f *Flow) refill(refill Refill) (KegArchive, error) {
+	keg := *f.keg
+	if refill.Keg != nil {
+		keg = *refill.Keg
+		if keg.Type == "" && keg.Volume == 0 {
+			keg.Type, keg.Volume = f.keg.Type, f.keg.Volume
+		}
+		if keg.ID == "" {
+			keg.ID = newKegID()
+		}
+	}
+	if keg.Volume <= 0 {
+		return KegArchive{}, fmt.Errorf("unknown keg volume")
+	}
+	if refill.Remaining < 0 || refill.Remaining > keg.Volume {
+		return KegArchive{}, fmt.Errorf("remaining volume %.2f out of range", refill.Remaining)
+	}
+	if refill.Beer != nil {
+		err := refill.Beer.Validate()
+		if err != nil {
+			return KegArchive{}, fmt.Errorf("invalid beer: %w", err)
+		}
+	}
+
+	now := f.clock.Now()
+	archive := KegArchive{
+		Time:             now,
+		Pin:              f.pinNumber,
+		Keg:              *f.keg,
+		Contents:         f.Contents,
+		Beer:             f.beer,
+		Poured:           f.TotalFlow(),
+		PouredByConstant: f.Dispensed(),
+		Pulses:           f.pulseTotal,
+	}
+
+	contents := refill.Contents
+	if contents == "" && refill.Beer != nil {
+		contents = refill.Beer.Name
+	}
+	if contents == "" {
+		contents = f.Contents
+	}
+	if refill.Beer != nil || contents != f.Contents {
+		f.beer = refill.Beer
+	}
+
+	if refill.Keg != nil {
+		f.keg = &keg
+	}
+	f.keg.refill(now)
+	f.Contents = contents
+	archive.RefilledWith = contents
+	f.dispensed = []PouredVolume{{FlowConstant: f.sensor.FlowConstant}}
+	if refill.Remaining > 0 {
+		f.dispense(f.keg.Volume - refill.Remaining)
+	}
+	f.pulseTotal = 0
+	f.partial = f.TotalFlow() > 0
+	f.kicked = false
+	f.proposal = nil
+	f.foam.reset()
+	f.publish(KegRefilled{
+		Time:     now,
+		Pin:      f.pinNumber,
+		Keg:      f.keg.ID,
+		Contents: contents,
+	})
+	return archive, nil
+}
+
+// Refill refills the keg on the provided flow meter, archiving the outgoing
+// keg's totals. Only the most recent archives are kept in the state, so every
+// archive is also appended to the archive log, if there is one. A replaced keg
+// is stored in the cellar
+func (s *State) Refill(flow *Flow, refill Refill) (KegArchive, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if refill.Keg != nil && refill.Keg.ID != "" {
+		for _, stored := range s.Cellar {
+			if stored.Keg.ID == refill.Keg.ID {
+				return KegArchive{}, fmt.Errorf("keg %s is stored, tap it instead", refill.Keg.ID)
+			}
+		}
+		for _, tapped := range s.Kegs {
+			if tapped != flow && tapped.keg.ID == refill.Keg.ID {
+				return KegArchive{}, fmt.Errorf("keg %s is tapped on %d", refill.Keg.ID, tapped.pinNumber)
+			}
+		}
+	}
+
+	archive, err := flow.Refill(refill)
+	if err != nil {
+		return KegArchive{}, err
+	}
+	s.Archive = append(s.Archive, archive)
+	if len(s.Archive) > defaultArchiveMemory {
+		s.Archive = s.Archive[len(s.Archive)-defaultArchiveMemory:]
+	}
+	if GlobalArchiveLog != nil {
+		err = GlobalArchiveLog.Append(archive)
+		if err != nil {
+			log.Println("ERR: append archive log:", err)
+		}
+	}
+
+	if refill.Keg != nil && refill.Keg.ID != archive.Keg.ID {
+		replaced := archive.Keg
+		if replaced.State == KegStateTapped {
+			replaced.State = KegStateFilled
+		}
+		s.Cellar = append(s.Cellar, StoredKeg{
+			Keg:      &replaced,
+			Contents: archive.Contents,
+			Beer:     archive.Beer,
+			Poured:   archive.PouredByConstant,
+		})
+	}
+	return archive, nil
+}
@@ -0,0 +1,79 @@
+package kegerator
+
+import (
+	"sync/atomic"
+)
+
+// pulseRing is a bounded, lock-free queue of pulse timestamps. Any number of
+// goroutines may push concurrently, but only one goroutine may pop
+//
+// Each slot carries a sequence number that indicates whether it is ready to be
+// written or read for a given position, so producers never wait on a lock or
+// on the consumer
+type pulseRing struct {
+	mask  uint64
+	slots []pulseSlot
+	head  atomic.Uint64 // next position to push
+	tail  atomic.Uint64 // next position to pop
+}
+
+type pulseSlot struct {
+	seq   atomic.Uint64
+	event int64
+}
+
+// newPulseRing initializes a ring with capacity for at least size pulses.
+// Capacity is rounded up to a power of two
+func newPulseRing(size int) *pulseRing {
+	capacity := 1
+	for capacity < size {
+		capacity <<= 1
+	}
+
+	r := &pulseRing{
+		mask:  uint64(capacity - 1),
+		slots: make([]pulseSlot, capacity),
+	}
+	for i := range r.slots {
+		r.slots[i].seq.Store(uint64(i))
+	}
+	return r
+}
+
+// push adds a pulse to the ring, returning false if the ring is full
+func (r *pulseRing) push(event int64) bool {
+	pos := r.head.Load()
+	for {
+		slot := &r.slots[pos&r.mask]
+		diff := int64(slot.seq.Load() - pos)
+		switch {
+		case diff == 0:
+			if r.head.CompareAndSwap(pos, pos+1) {
+				slot.event = event
+				slot.seq.Store(pos + 1)
+				return true
+			}
+			pos = r.head.Load()
+		case diff < 0:
+			return false
+		default:
+			// another producer claimed this position
+			pos = r.head.Load()
+		}
+	}
+}
+
+// pop removes the oldest pulse from the ring, returning false if the ring is
+// empty. A pulse that is still being written is treated as absent
+func (r *pulseRing) pop() (int64, bool) {
+	pos := r.tail.Load()
+	slot := &r.slots[pos&r.mask]
+	if int64(slot.seq.Load()-(pos+1)) < 0 {
+		return 0, false
+	}
+
+	event := slot.event
+	slot.seq.Store(pos + r.mask + 1)
+	r.tail.Store(pos + 1)
+	return event, true
+}
@@ -0,0 +1,97 @@
+package kegerator
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestPulseRing(t *testing.T) {
+	ring := newPulseRing(3)
+	if len(ring.slots) != 4 {
+		t.Fatalf("capacity = %d, want 4", len(ring.slots))
+	}
+
+	if _, ok := ring.pop(); ok {
+		t.Fatalf("popped from empty ring")
+	}
+
+	// wrap around the ring several times, filling it each time
+	var next int64
+	for round := 0; round < 3; round++ {
+		for i := 0; i < len(ring.slots); i++ {
+			if !ring.push(next + int64(i)) {
+				t.Fatalf("round %d: push %d failed before ring was full", round, i)
+			}
+		}
+		if ring.push(-1) {
+			t.Fatalf("round %d: pushed to full ring", round)
+		}
+
+		for i := 0; i < len(ring.slots); i++ {
+			event, ok := ring.pop()
+			if !ok || event != next {
+				t.Fatalf("round %d: pop = (%d, %t), want (%d, true)", round, event, ok, next)
+			}
+			next++
+		}
+		if _, ok := ring.pop(); ok {
+			t.Fatalf("round %d: popped from empty ring", round)
+		}
+	}
+}
+
+func TestPulseRingConcurrent(t *testing.T) {
+	const (
+		producers = 8
+		pushes    = 10000
+	)
+	ring := newPulseRing(64)
+
+	// each producer pushes increasing events, which the consumer must see in
+	// order for that producer, with none lost or duplicated
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < pushes; i++ {
+				for !ring.push(int64(p*pushes + i)) {
+					runtime.Gosched()
+				}
+			}
+		}(p)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	next := make([]int, producers)
+	received := 0
+	for received < producers*pushes {
+		event, ok := ring.pop()
+		if !ok {
+			select {
+			case <-done:
+				// every push has completed, so the rest must be in the ring
+				event, ok = ring.pop()
+				if !ok {
+					t.Fatalf("received %d events, want %d", received, producers*pushes)
+				}
+			default:
+				runtime.Gosched()
+				continue
+			}
+		}
+
+		p, i := int(event)/pushes, int(event)%pushes
+		if i != next[p] {
+			t.Fatalf("producer %d: event %d, want %d", p, i, next[p])
+		}
+		next[p]++
+		received++
+	}
+}
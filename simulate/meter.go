@@ -0,0 +1,205 @@
+package simulate
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	keg "github.com/subtlepseudonym/kegerator"
+)
+
+const (
+	emitInterval    = 20 * time.Millisecond  // how often due pulses are delivered
+	rampDuration    = 500 * time.Millisecond // time taken to fully open or close the tap
+	minFlowRate     = 1.5                    // liters per minute
+	maxFlowRate     = 3.0                    // liters per minute
+	pulseJitter     = 0.05                   // ratio of pulse interval
+	maxNoisePulses  = 3                      // pulses per burst of idle noise
+	noisePulseDelta = 2 * time.Millisecond
+)
+
+// pourVolumes is a weighted list of common serving sizes, in liters
+var pourVolumes = []struct {
+	volume float64
+	weight float64
+}{
+	{volume: 0.473, weight: 0.55}, // pint
+	{volume: 0.355, weight: 0.2},  // 12oz
+	{volume: 0.15, weight: 0.15},  // taster
+	{volume: 0.05, weight: 0.1},   // top-off
+}
+
+// Meter is a pulse source that generates pours and idle noise in real time
+//
+// Pour and noise events are each exponentially distributed in time. Pours open
+// and close the tap gradually, so pulse frequency ramps up and down at either
+// end of a pour
+type Meter struct {
+	source *keg.MemoryPulseSource
+	meter  keg.FlowMeter // the simulated hardware, unaffected by calibrating the flow
+	rand   *rand.Rand
+
+	pourInterval  time.Duration
+	noiseInterval time.Duration
+
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+// NewMeter initializes a simulated flow meter. The flow meter is copied, as the
+// original is recalibrated by its flow while pulses are being generated
+func NewMeter(meter *keg.FlowMeter, pourInterval, noiseInterval time.Duration, r *rand.Rand) *Meter {
+	return &Meter{
+		source:        keg.NewMemoryPulseSource(),
+		meter:         *meter,
+		rand:          r,
+		pourInterval:  pourInterval,
+		noiseInterval: noiseInterval,
+	}
+}
+
+// Open begins generating pulses
+func (m *Meter) Open(handler func(int64)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stop != nil {
+		return fmt.Errorf("meter already open")
+	}
+
+	err := m.source.Open(handler)
+	if err != nil {
+		return err
+	}
+
+	m.stop = make(chan struct{})
+	go m.run(m.stop)
+	return nil
+}
+
+// Close stops generating pulses
+func (m *Meter) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stop == nil {
+		return nil
+	}
+	close(m.stop)
+	m.stop = nil
+	return m.source.Close()
+}
+
+func (m *Meter) run(stop chan struct{}) {
+	now := time.Now()
+	nextPour := now.Add(m.exponential(m.pourInterval))
+	nextNoise := now.Add(m.exponential(m.noiseInterval))
+
+	for {
+		next := nextPour
+		if nextNoise.Before(next) {
+			next = nextNoise
+		}
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-stop:
+			return
+		}
+
+		if next == nextPour {
+			if !m.pour(stop) {
+				return
+			}
+			now = time.Now()
+			nextPour = now.Add(m.exponential(m.pourInterval))
+			if nextNoise.Before(now) {
+				nextNoise = now.Add(m.exponential(m.noiseInterval))
+			}
+		} else {
+			m.noise()
+			nextNoise = time.Now().Add(m.exponential(m.noiseInterval))
+		}
+	}
+}
+
+// pour emits pulses for a single pour in real time. It returns false if the
+// meter was closed before the pour finished
+func (m *Meter) pour(stop chan struct{}) bool {
+	pulses := m.pourPulses(time.Now())
+	ticker := time.NewTicker(emitInterval)
+	defer ticker.Stop()
+
+	for len(pulses) > 0 {
+		select {
+		case now := <-ticker.C:
+			var i int
+			for i < len(pulses) && pulses[i] <= now.UnixMicro() {
+				m.source.Pulse(pulses[i])
+				i++
+			}
+			pulses = pulses[i:]
+		case <-stop:
+			return false
+		}
+	}
+	return true
+}
+
+// pourPulses generates timestamps for every pulse in a pour beginning at start
+func (m *Meter) pourPulses(start time.Time) []int64 {
+	volume := m.pourVolume()
+	rate := minFlowRate + m.rand.Float64()*(maxFlowRate-minFlowRate)
+
+	// F = KQ; F is pulses per second; Q is liters per minute
+	count := int(volume * m.meter.FlowConstant * 60)
+	fullInterval := 1.0 / (m.meter.FlowConstant * rate)
+
+	pulses := make([]int64, 0, count)
+	var elapsed float64 // seconds
+	for i := 0; i < count; i++ {
+		// estimate time remaining from pulses remaining at full flow
+		remaining := float64(count-i) * fullInterval
+		opening := math.Min(elapsed, remaining) / rampDuration.Seconds()
+		if opening > 1 {
+			opening = 1
+		}
+		// avoid stalling when the tap is nearly closed
+		opening = math.Max(opening, 0.1)
+
+		interval := fullInterval / opening
+		interval *= 1 + (m.rand.Float64()*2-1)*pulseJitter
+		elapsed += interval
+
+		pulses = append(pulses, start.Add(time.Duration(elapsed*float64(time.Second))).UnixMicro())
+	}
+
+	return pulses
+}
+
+func (m *Meter) pourVolume() float64 {
+	r := m.rand.Float64()
+	for _, p := range pourVolumes {
+		if r < p.weight {
+			return p.volume
+		}
+		r -= p.weight
+	}
+	return pourVolumes[0].volume
+}
+
+// noise emits a short burst of pulses, such as those caused by vibration or
+// electrical interference, that is too small to constitute a pour
+func (m *Meter) noise() {
+	now := time.Now()
+	count := 1 + m.rand.Intn(maxNoisePulses)
+	for i := 0; i < count; i++ {
+		m.source.Pulse(now.Add(time.Duration(i) * noisePulseDelta).UnixMicro())
+	}
+}
+
+func (m *Meter) exponential(mean time.Duration) time.Duration {
+	return time.Duration(m.rand.ExpFloat64() * float64(mean))
+}
@@ -0,0 +1,73 @@
+package simulate
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	compressorPeriod    = 25 * time.Minute // duration of a full compressor cycle
+	compressorAmplitude = 1.0              // temperature swing, in celsius
+	driftReversion      = 1.0 / 3600       // rate of return to set point, per second
+	driftVolatility     = 0.01             // celsius per root second
+	readNoise           = 0.05             // celsius
+	humidityAmplitude   = 5.0              // humidity swing, in percent
+	retryProbability    = 0.05
+)
+
+// Sensor is a DHT reader that reports a fridge temperature cycling with the
+// compressor, plus slow random drift about the set point and read noise
+type Sensor struct {
+	setPoint float64
+	humidity float64
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	start time.Time
+	last  time.Time
+	drift float64
+}
+
+func NewSensor(temperature, humidity float64, r *rand.Rand) *Sensor {
+	now := time.Now()
+	return &Sensor{
+		setPoint: temperature,
+		humidity: humidity,
+		rand:     r,
+		start:    now,
+		last:     now,
+	}
+}
+
+func (s *Sensor) Read(ctx context.Context, retries int) (float32, float32, int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	dt := now.Sub(s.last).Seconds()
+	s.last = now
+
+	// mean-reverting random walk
+	s.drift += -driftReversion*s.drift*dt + driftVolatility*math.Sqrt(dt)*s.rand.NormFloat64()
+
+	phase := 2 * math.Pi * now.Sub(s.start).Seconds() / compressorPeriod.Seconds()
+	cycle := math.Sin(phase)
+
+	temperature := s.setPoint + compressorAmplitude*cycle + s.drift + readNoise*s.rand.NormFloat64()
+	humidity := s.humidity - humidityAmplitude*cycle + s.rand.NormFloat64()
+	humidity = math.Max(0, math.Min(100, humidity))
+
+	var retried int
+	if retries > 0 && s.rand.Float64() < retryProbability {
+		retried = 1
+	}
+
+	return float32(temperature), float32(humidity), retried, nil
+}
@@ -0,0 +1,78 @@
+// Package simulate provides software sensors that stand in for flow meters and
+// DHT sensors, allowing the kegerator daemon to run without gpio hardware
+package simulate
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	keg "github.com/subtlepseudonym/kegerator"
+
+	"github.com/d2r2/go-dht"
+)
+
+const (
+	defaultPourInterval  = 20 * time.Minute // mean time between pours
+	defaultNoiseInterval = 5 * time.Minute  // mean time between bursts of idle noise
+	defaultTemperature   = 3.5              // fridge set point, in celsius
+	defaultHumidity      = 55.0             // mean relative humidity, in percent
+)
+
+// Hardware implements kegerator.Hardware with simulated sensors
+type Hardware struct {
+	PourInterval  time.Duration
+	NoiseInterval time.Duration
+	Temperature   float64
+	Humidity      float64
+
+	seed int64
+}
+
+// NewHardware initializes simulated hardware with default parameters. Each
+// simulated sensor derives its random source from seed
+func NewHardware(seed int64) *Hardware {
+	return &Hardware{
+		PourInterval:  defaultPourInterval,
+		NoiseInterval: defaultNoiseInterval,
+		Temperature:   defaultTemperature,
+		Humidity:      defaultHumidity,
+		seed:          seed,
+	}
+}
+
+// PulseSources returns a simulated flow meter for each line. Lines requested by
+// name are assigned the offset given by any trailing digits in the name, such
+// that GPIO17 is assigned pin 17
+func (h *Hardware) PulseSources(lines []keg.FlowLine) ([]keg.PulseSource, error) {
+	sources := make([]keg.PulseSource, len(lines))
+	for i, line := range lines {
+		if line.Name != "" {
+			digits := strings.TrimLeftFunc(line.Name, func(r rune) bool {
+				return !unicode.IsDigit(r)
+			})
+			if offset, err := strconv.Atoi(digits); err == nil {
+				lines[i].Pin = offset
+				line.Pin = offset
+			}
+		}
+
+		sources[i] = NewMeter(
+			line.Sensor,
+			h.PourInterval,
+			h.NoiseInterval,
+			rand.New(rand.NewSource(h.seed+int64(line.Pin))),
+		)
+	}
+	return sources, nil
+}
+
+func (h *Hardware) DHTReader(pin int, model dht.SensorType) keg.DHTReader {
+	return NewSensor(
+		h.Temperature,
+		h.Humidity,
+		rand.New(rand.NewSource(h.seed-int64(pin))),
+	)
+}
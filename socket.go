@@ -0,0 +1,326 @@
+package kegerator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultSocketPing = 30 * time.Second // detects clients that disappear without closing
+
+// Topics that socket clients may subscribe to
+const (
+	TopicState = "state"
+	TopicDHT   = "dht"
+	TopicPours = "pours"
+)
+
+// Commands that socket clients may send
+const (
+	CommandSubscribe   = "subscribe"
+	CommandUnsubscribe = "unsubscribe"
+	CommandRefill      = "refill"
+	CommandCalibrate   = "calibrate"
+)
+
+// socketKeg is the type of message carrying the state of a single keg, sent to
+// clients subscribed to state whenever the keg changes
+const socketKeg = "keg"
+
+// socketCommand is a message sent by a socket client. ID is echoed in the
+// command's result so that clients may match results to commands
+type socketCommand struct {
+	ID     string   `json:"id,omitempty"`
+	Type   string   `json:"type"`
+	Topics []string `json:"topics,omitempty"`
+
+	Pin         int     `json:"pin"`
+	Contents    string  `json:"contents,omitempty"`
+	Constant    float64 `json:"constant,omitempty"`
+	Coefficient float64 `json:"coefficient,omitempty"`
+
+	// refill a new keg, see Refill
+	Keg       string  `json:"keg,omitempty"` // keg type
+	KegID     string  `json:"keg_id,omitempty"`
+	Volume    float64 `json:"volume,omitempty"`
+	Remaining float64 `json:"remaining,omitempty"`
+	Beer      *Beer   `json:"beer,omitempty"`
+}
+
+// socketMessage is a message sent to a socket client. Results have type
+// "result" and carry an error if the command failed. Other messages carry the
+// data for a subscribed topic, with events typed by their event type
+type socketMessage struct {
+	ID    string      `json:"id,omitempty"`
+	Type  string      `json:"type"`
+	Error string      `json:"error,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// socketClient tracks the topics a socket client is subscribed to
+type socketClient struct {
+	conn *wsConn
+
+	mu     sync.Mutex
+	topics map[string]bool
+}
+
+// SocketHandler upgrades the request to a websocket. Clients subscribe to
+// keg state, DHT readings and pour events, and may send refill and calibrate
+// commands, all as JSON messages
+func SocketHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		log.Printf("upgrade socket: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	client := &socketClient{
+		conn:   conn,
+		topics: make(map[string]bool),
+	}
+
+	sub := DefaultEventBus.Subscribe(0)
+	defer sub.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.read()
+	}()
+
+	ping := time.NewTicker(defaultSocketPing)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case event := <-sub.Events():
+			err = client.forward(event)
+		case <-ping.C:
+			err = conn.Ping()
+		case <-done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			log.Printf("write socket: %s", err)
+			return
+		}
+	}
+}
+
+// read handles commands until the client disconnects
+func (c *socketClient) read() {
+	for {
+		message, err := c.conn.ReadMessage()
+		if err != nil {
+			if !errors.Is(err, errWebSocketClosed) && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("read socket: %s", err)
+			}
+			return
+		}
+
+		var command socketCommand
+		err = json.Unmarshal(message, &command)
+		if err == nil {
+			err = c.handle(command)
+		}
+
+		result := socketMessage{
+			ID:   command.ID,
+			Type: "result",
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		err = c.send(result)
+		if err != nil {
+			log.Printf("write socket: %s", err)
+			return
+		}
+	}
+}
+
+// handle applies a command from the client
+func (c *socketClient) handle(command socketCommand) error {
+	switch command.Type {
+	case CommandSubscribe:
+		for _, topic := range command.Topics {
+			switch topic {
+			case TopicState, TopicDHT, TopicPours:
+			default:
+				return fmt.Errorf("unknown topic %q", topic)
+			}
+		}
+
+		c.mu.Lock()
+		for _, topic := range command.Topics {
+			c.topics[topic] = true
+		}
+		c.mu.Unlock()
+
+		for _, topic := range command.Topics {
+			if topic == TopicState {
+				return c.sendState()
+			}
+		}
+		return nil
+	case CommandUnsubscribe:
+		c.mu.Lock()
+		for _, topic := range command.Topics {
+			delete(c.topics, topic)
+		}
+		c.mu.Unlock()
+		return nil
+	case CommandRefill:
+		flow := findFlow(command.Pin)
+		if flow == nil {
+			return fmt.Errorf("no keg found on pin %d", command.Pin)
+		}
+
+		keg, err := NewRefillKeg(command.Keg, command.KegID, command.Volume)
+		if err != nil {
+			return err
+		}
+		archive, err := GlobalState.Refill(flow, Refill{
+			Keg:       keg,
+			Contents:  command.Contents,
+			Beer:      command.Beer,
+			Remaining: command.Remaining,
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Refilled %d with contents: %s", archive.Pin, archive.RefilledWith)
+		return nil
+	case CommandCalibrate:
+		flow := findFlow(command.Pin)
+		if flow == nil {
+			return fmt.Errorf("no keg found on pin %d", command.Pin)
+		}
+
+		GlobalState.mu.Lock()
+		defer GlobalState.mu.Unlock()
+
+		constant := command.Constant
+		if constant == 0 && command.Coefficient != 0 {
+			flow.Lock()
+			constant = scaledFlowConstant(flow.sensor.FlowConstant, command.Coefficient)
+			flow.Unlock()
+		}
+		if constant <= 0 {
+			return fmt.Errorf("positive constant or coefficient required")
+		}
+		flow.SetFlowConstant(constant)
+		return nil
+	}
+
+	return fmt.Errorf("unknown command %q", command.Type)
+}
+
+// forward sends an event to the client if it is subscribed to the event's
+// topic. Events that change a keg's totals also send the keg's updated state
+// to clients subscribed to state
+func (c *socketClient) forward(event Event) error {
+	c.mu.Lock()
+	state, dht, pours := c.topics[TopicState], c.topics[TopicDHT], c.topics[TopicPours]
+	c.mu.Unlock()
+
+	var pin int
+	switch event := event.(type) {
+	case DHTReading:
+		if !dht {
+			return nil
+		}
+		return c.send(socketMessage{Type: event.EventType(), Data: event})
+	case PourStarted, PourProgress:
+		if !pours {
+			return nil
+		}
+		return c.send(socketMessage{Type: event.EventType(), Data: event})
+	case PourFinished:
+		pin = event.Pin
+	case PourDiscarded:
+		pin = event.Pin
+	case KegRefilled:
+		pin = event.Pin
+	case KegTapped:
+		pin = event.Pin
+	case KegKicked:
+		pin = event.Pin
+	case Calibrated:
+		pin = event.Pin
+	default:
+		return nil
+	}
+
+	switch event.(type) {
+	case PourFinished, PourDiscarded:
+		if pours {
+			err := c.send(socketMessage{Type: event.EventType(), Data: event})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !state {
+		return nil
+	}
+	return c.sendKeg(pin)
+}
+
+// sendKeg sends the current state of the keg on the provided pin. Only the
+// full state is sent on subscribing, as encoding it requires locking every
+// keg
+func (c *socketClient) sendKeg(pin int) error {
+	flow := findFlow(pin)
+	if flow == nil {
+		return nil
+	}
+
+	flow.Lock()
+	data, err := json.Marshal(flow.output())
+	flow.Unlock()
+	if err != nil {
+		return fmt.Errorf("marshal keg: %w", err)
+	}
+
+	return c.send(socketMessage{
+		Type: socketKeg,
+		Data: json.RawMessage(data),
+	})
+}
+
+// sendState sends the current state of every keg and DHT sensor
+func (c *socketClient) sendState() error {
+	GlobalState.mu.Lock()
+	GlobalState.update()
+	data, err := json.Marshal(GlobalState)
+	GlobalState.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+
+	return c.send(socketMessage{
+		Type: TopicState,
+		Data: json.RawMessage(data),
+	})
+}
+
+func (c *socketClient) send(message socketMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("marshal message: %w", err)
+	}
+	return c.conn.WriteText(data)
+}
@@ -0,0 +1,104 @@
+package kegerator
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultStreamHeartbeat = 15 * time.Second // keeps idle connections open through proxies
+
+// PourStreamHandler streams pour events as server-sent events until the client
+// disconnects. Events may be limited to a single keg with the pin query param
+func PourStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	pin := -1
+	if r.FormValue("pin") != "" {
+		var err error
+		pin, err = strconv.Atoi(r.FormValue("pin"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf(`{"msg": "bad pin value", "error": %q}`, err)))
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "streaming unsupported"}`))
+		return
+	}
+
+	sub := DefaultEventBus.Subscribe(0)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(defaultStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event := <-sub.Events():
+			pourEvent, ok := streamedPourEvent(event)
+			if !ok || (pin >= 0 && pourEvent.Pin != pin) {
+				continue
+			}
+
+			err := writeServerSentEvent(w, event)
+			if err != nil {
+				log.Printf("write pour stream: %s", err)
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			_, err := fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// streamedPourEvent returns the pour described by events that are sent to pour
+// streams
+func streamedPourEvent(event Event) (PourEvent, bool) {
+	switch e := event.(type) {
+	case PourStarted:
+		return e.PourEvent, true
+	case PourProgress:
+		return e.PourEvent, true
+	case PourFinished:
+		return e.PourEvent, true
+	case PourDiscarded:
+		return e.PourEvent, true
+	}
+	return PourEvent{}, false
+}
+
+// writeServerSentEvent writes an event named by its type, with the event as
+// JSON data
+func writeServerSentEvent(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.EventType(), data)
+	return err
+}
@@ -0,0 +1,234 @@
+package kegerator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Trace files are plain text. The first line is a header describing the flow
+// meter that the trace was recorded from, followed by one pulse timestamp, in
+// microseconds, per line:
+//
+//	# pin=17 model=fl-s401a flow_constant=98
+//	1681300000000000
+//	1681300000005102
+const traceHeaderPrefix = "#"
+
+const (
+	defaultTraceFlushRecords  = 256             // buffered pulses written at once
+	defaultTraceFlushInterval = 2 * time.Second // longest that a pulse is buffered
+)
+
+// Trace contains the raw pulses recorded from a single flow meter
+type Trace struct {
+	Pin    int
+	Sensor FlowMeter
+	Events []int64 // microseconds
+}
+
+// TraceWriter records raw flow meter pulses to a trace file. Pulses are
+// buffered and written after defaultTraceFlushRecords pulses or
+// defaultTraceFlushInterval, whichever comes first, so that little of a trace
+// is lost if the process dies without closing the writer
+type TraceWriter struct {
+	mu       sync.Mutex
+	w        *bufio.Writer
+	syncer   interface{ Sync() error }
+	closer   io.Closer
+	err      error
+	buffered int         // pulses written to w since it was last flushed
+	timer    *time.Timer // flushes buffered pulses, nil while none are buffered
+	closed   bool
+}
+
+// NewTraceWriter writes a trace header to w and returns a writer for recording
+// pulses. If w is an io.Closer, it is closed when the trace writer is closed
+func NewTraceWriter(w io.Writer, pin int, sensor *FlowMeter) (*TraceWriter, error) {
+	t := &TraceWriter{
+		w: bufio.NewWriter(w),
+	}
+	if closer, ok := w.(io.Closer); ok {
+		t.closer = closer
+	}
+	if syncer, ok := w.(interface{ Sync() error }); ok {
+		t.syncer = syncer
+	}
+
+	_, err := fmt.Fprintf(
+		t.w,
+		"%s pin=%d model=%s flow_constant=%s\n",
+		traceHeaderPrefix,
+		pin,
+		sensor.Model,
+		strconv.FormatFloat(sensor.FlowConstant, 'f', -1, 64),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("write trace header: %w", err)
+	}
+
+	return t, nil
+}
+
+// Record appends a single pulse to the trace. After the first write error,
+// subsequent pulses are discarded and the error is returned by Close
+func (t *TraceWriter) Record(event int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.err != nil || t.closed {
+		return
+	}
+	_, t.err = t.w.WriteString(strconv.FormatInt(event, 10) + "\n")
+	if t.err != nil {
+		return
+	}
+
+	t.buffered++
+	if t.buffered >= defaultTraceFlushRecords {
+		t.flush()
+		return
+	}
+	if t.timer == nil {
+		t.timer = time.AfterFunc(defaultTraceFlushInterval, func() {
+			err := t.Flush()
+			if err != nil {
+				log.Println("ERR: flush trace:", err)
+			}
+		})
+	}
+}
+
+// Flush writes any buffered pulses to the underlying writer and, if it is a
+// file, commits them to disk
+func (t *TraceWriter) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return t.err
+	}
+	t.flush()
+	if t.err == nil && t.syncer != nil {
+		t.err = t.syncer.Sync()
+	}
+	return t.err
+}
+
+// flush must be called while holding the trace writer's lock
+func (t *TraceWriter) flush() {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.buffered = 0
+	if t.err != nil {
+		return
+	}
+	t.err = t.w.Flush()
+}
+
+// Close flushes buffered pulses and closes the underlying writer. Pulses
+// recorded after the trace writer is closed are discarded
+func (t *TraceWriter) Close() error {
+	err := t.Flush()
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	if t.closer != nil {
+		closeErr := t.closer.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// ReadTrace parses a trace file recorded by TraceWriter
+func ReadTrace(r io.Reader) (*Trace, error) {
+	var trace Trace
+	scanner := bufio.NewScanner(r)
+
+	var line int
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, traceHeaderPrefix) {
+			err := parseTraceHeader(&trace, strings.TrimPrefix(text, traceHeaderPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			continue
+		}
+
+		event, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: parse event: %w", line, err)
+		}
+		trace.Events = append(trace.Events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read trace: %w", err)
+	}
+
+	return &trace, nil
+}
+
+func parseTraceHeader(trace *Trace, header string) error {
+	for _, field := range strings.Fields(header) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+
+		var err error
+		switch key {
+		case "pin":
+			trace.Pin, err = strconv.Atoi(value)
+		case "model":
+			trace.Sensor.Model = value
+		case "flow_constant":
+			trace.Sensor.FlowConstant, err = strconv.ParseFloat(value, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("parse header field %q: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// Replay passes each event to update, sleeping between events to reproduce the
+// timing of the original pulses. Speed scales the rate of playback, such that a
+// speed of 2 replays events twice as quickly as they were recorded. A speed of
+// zero or less replays events without delay
+//
+// If clock is non-nil, it is set to the time of each event before the event is
+// passed to update. This keeps timers, such as pour pruning, consistent with
+// the recorded timing regardless of playback speed
+//
+// Replay returns early if stop is closed
+func Replay(events []int64, speed float64, clock *ManualClock, update func(int64), stop <-chan struct{}) {
+	for i, event := range events {
+		if i > 0 && speed > 0 {
+			delta := time.Duration(event-events[i-1]) * time.Microsecond
+			select {
+			case <-time.After(time.Duration(float64(delta) / speed)):
+			case <-stop:
+				return
+			}
+		}
+		if clock != nil {
+			clock.Set(time.UnixMicro(event))
+		}
+		update(event)
+	}
+}
@@ -0,0 +1,307 @@
+package kegerator
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocket opcodes, per RFC 6455
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+const (
+	wsGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxMessageSize = 64 * 1024 // bytes, commands are small
+	wsWriteTimeout   = 10 * time.Second
+)
+
+var errWebSocketClosed = errors.New("websocket closed")
+
+// SocketOrigins lists the origins, such as "http://kiosk.local:8080", that
+// browsers may open websocket connections from in addition to the server's own
+// origin. Connections from other origins are refused so that web pages cannot
+// send commands on behalf of the browsers that visit them
+var SocketOrigins []string
+
+// wsConn is a minimal server side websocket connection. Reads must not be
+// called concurrently, but writes may be
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	mu     sync.Mutex // guards writes
+	closed bool
+}
+
+// upgradeWebSocket completes the websocket opening handshake and takes over
+// the request's connection. If the request is not a valid websocket upgrade,
+// an error is written to the response and returned
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("method %s not allowed", r.Method)
+	}
+
+	err := checkOrigin(r)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return nil, err
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket"):
+		err = fmt.Errorf("not a websocket upgrade")
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		err = fmt.Errorf("unsupported websocket version %q", r.Header.Get("Sec-WebSocket-Version"))
+	case key == "":
+		err = fmt.Errorf("missing websocket key")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"error": %q}`, err)))
+		return nil, err
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "websockets unsupported"}`))
+		return nil, fmt.Errorf("connection cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("hijack connection: %w", err)
+	}
+
+	hash := sha1.Sum([]byte(key + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(hash[:])
+	_, err = fmt.Fprintf(
+		rw,
+		"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		accept,
+	)
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write handshake: %w", err)
+	}
+
+	return &wsConn{
+		conn: conn,
+		rw:   rw,
+	}, nil
+}
+
+// checkOrigin allows requests from the server's own origin and those listed in
+// SocketOrigins. Requests without an origin are not sent by browsers, so they
+// are allowed
+func checkOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("parse origin: %w", err)
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return nil
+	}
+	for _, allowed := range SocketOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %q not allowed", origin)
+}
+
+// headerContains reports whether any comma-separated value of the header
+// matches token, ignoring case
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text or binary message from the client. Ping
+// frames are answered while reading. Once the client closes the connection,
+// errWebSocketClosed is returned
+func (c *wsConn) ReadMessage() ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsPing:
+			err = c.write(wsPong, payload)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.write(wsClose, payload)
+			return nil, errWebSocketClosed
+		case wsText, wsBinary:
+			if message != nil {
+				return nil, fmt.Errorf("unexpected data frame during fragmented message")
+			}
+			message = payload
+		case wsContinuation:
+			if message == nil {
+				return nil, fmt.Errorf("unexpected continuation frame")
+			}
+			message = append(message, payload...)
+		default:
+			return nil, fmt.Errorf("unknown opcode %#x", opcode)
+		}
+
+		if len(message) > wsMaxMessageSize {
+			return nil, fmt.Errorf("message exceeds %d bytes", wsMaxMessageSize)
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// readFrame reads a single frame, unmasking its payload
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	_, err := io.ReadFull(c.rw, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, fmt.Errorf("reserved bits set without extension")
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, fmt.Errorf("unmasked client frame")
+	}
+
+	length := uint64(header[1] & 0x7f)
+	if opcode >= wsClose && (!fin || length > 125) {
+		return false, 0, nil, fmt.Errorf("fragmented or oversized control frame")
+	}
+	switch length {
+	case 126:
+		var extended [2]byte
+		_, err = io.ReadFull(c.rw, extended[:])
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		_, err = io.ReadFull(c.rw, extended[:])
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if length > wsMaxMessageSize {
+		return false, 0, nil, fmt.Errorf("frame exceeds %d bytes", wsMaxMessageSize)
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(c.rw, mask[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.rw, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// WriteText sends a text message to the client
+func (c *wsConn) WriteText(data []byte) error {
+	return c.write(wsText, data)
+}
+
+// Ping sends a ping to the client
+func (c *wsConn) Ping() error {
+	return c.write(wsPing, nil)
+}
+
+// write sends a single unmasked frame
+func (c *wsConn) write(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errWebSocketClosed
+	}
+	if opcode == wsClose {
+		c.closed = true
+	}
+
+	header := []byte{0x80 | opcode}
+	length := len(payload)
+	switch {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := c.rw.Write(header)
+	if err == nil {
+		_, err = c.rw.Write(payload)
+	}
+	if err == nil {
+		err = c.rw.Flush()
+	}
+	return err
+}
+
+// Close sends a close frame, if one has not been sent, and closes the
+// underlying connection
+func (c *wsConn) Close() error {
+	c.write(wsClose, nil)
+	return c.conn.Close()
+}
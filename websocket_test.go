@@ -0,0 +1,343 @@
+package kegerator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// pipeConn returns a websocket connection and the client end of the pipe that
+// it reads from and writes to
+func pipeConn(t *testing.T) (*wsConn, net.Conn) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	conn := &wsConn{
+		conn: server,
+		rw:   bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)),
+	}
+	return conn, client
+}
+
+// clientFrame encodes a masked frame, as sent by a client
+func clientFrame(fin bool, opcode byte, payload []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// readServerFrame decodes an unmasked frame, as sent by the server
+func readServerFrame(t *testing.T, r *bufio.Reader) (bool, byte, []byte) {
+	t.Helper()
+
+	var header [2]byte
+	readFull(t, r, header[:])
+	if header[1]&0x80 != 0 {
+		t.Fatalf("server frame is masked")
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		readFull(t, r, extended[:])
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		readFull(t, r, extended[:])
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+
+	payload := make([]byte, length)
+	readFull(t, r, payload)
+	return header[0]&0x80 != 0, header[0] & 0x0f, payload
+}
+
+func readFull(t *testing.T, r io.Reader, buf []byte) {
+	t.Helper()
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		t.Fatalf("read frame: %s", err)
+	}
+}
+
+// send writes frames from the client without blocking the test
+func send(client net.Conn, frames ...[]byte) {
+	go func() {
+		for _, frame := range frames {
+			client.Write(frame)
+		}
+	}()
+}
+
+func TestReadMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"short", []byte(`{"type":"subscribe"}`)},
+		{"empty", []byte{}},
+		{"16-bit length", bytes.Repeat([]byte("a"), 300)},
+		{"64-bit length", bytes.Repeat([]byte("b"), wsMaxMessageSize)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, client := pipeConn(t)
+			send(client, clientFrame(true, wsText, test.payload))
+
+			message, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("read message: %s", err)
+			}
+			if !bytes.Equal(message, test.payload) {
+				t.Errorf("message = %q, want %q", message, test.payload)
+			}
+		})
+	}
+}
+
+func TestReadMessageFragmented(t *testing.T) {
+	conn, client := pipeConn(t)
+	reader := bufio.NewReader(client)
+	send(client,
+		clientFrame(false, wsText, []byte("hello, ")),
+		clientFrame(true, wsPing, []byte("ping")),
+		clientFrame(true, wsContinuation, []byte("world")),
+	)
+
+	// the ping is answered while the message is read, so the pong must be
+	// consumed for the read to complete
+	done := make(chan []byte)
+	go func() {
+		message, err := conn.ReadMessage()
+		if err != nil {
+			t.Errorf("read message: %s", err)
+		}
+		done <- message
+	}()
+
+	fin, opcode, payload := readServerFrame(t, reader)
+	if !fin || opcode != wsPong || string(payload) != "ping" {
+		t.Errorf("reply = (%t, %#x, %q), want pong with ping payload", fin, opcode, payload)
+	}
+
+	message := <-done
+	if string(message) != "hello, world" {
+		t.Errorf("message = %q, want %q", message, "hello, world")
+	}
+}
+
+func TestReadMessageClose(t *testing.T) {
+	conn, client := pipeConn(t)
+	reader := bufio.NewReader(client)
+	send(client, clientFrame(true, wsClose, []byte{0x03, 0xe8}))
+
+	done := make(chan error)
+	go func() {
+		_, err := conn.ReadMessage()
+		done <- err
+	}()
+
+	_, opcode, payload := readServerFrame(t, reader)
+	if opcode != wsClose || !bytes.Equal(payload, []byte{0x03, 0xe8}) {
+		t.Errorf("reply = (%#x, %v), want close echoing status", opcode, payload)
+	}
+	if err := <-done; err != errWebSocketClosed {
+		t.Errorf("err = %v, want %v", err, errWebSocketClosed)
+	}
+
+	// no further frames are written once the close frame has been sent
+	if err := conn.WriteText([]byte("late")); err != errWebSocketClosed {
+		t.Errorf("write after close err = %v, want %v", err, errWebSocketClosed)
+	}
+}
+
+func TestReadMessageInvalid(t *testing.T) {
+	unmasked := clientFrame(true, wsText, []byte("hi"))
+	unmasked[1] &^= 0x80
+
+	reserved := clientFrame(true, wsText, []byte("hi"))
+	reserved[0] |= 0x40
+
+	tests := []struct {
+		name   string
+		frames [][]byte
+	}{
+		{"unmasked", [][]byte{unmasked}},
+		{"reserved bits", [][]byte{reserved}},
+		{"unknown opcode", [][]byte{clientFrame(true, 0x3, nil)}},
+		{"fragmented control", [][]byte{clientFrame(false, wsPing, nil)}},
+		{"oversized control", [][]byte{clientFrame(true, wsPing, bytes.Repeat([]byte("p"), 126))}},
+		{"oversized frame", [][]byte{clientFrame(true, wsText, bytes.Repeat([]byte("a"), wsMaxMessageSize+1))}},
+		{"oversized message", [][]byte{
+			clientFrame(false, wsText, bytes.Repeat([]byte("a"), wsMaxMessageSize)),
+			clientFrame(true, wsContinuation, []byte("a")),
+		}},
+		{"continuation first", [][]byte{clientFrame(true, wsContinuation, []byte("a"))}},
+		{"interleaved data", [][]byte{
+			clientFrame(false, wsText, []byte("a")),
+			clientFrame(true, wsText, []byte("b")),
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, client := pipeConn(t)
+			send(client, test.frames...)
+
+			_, err := conn.ReadMessage()
+			if err == nil {
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		conn, client := pipeConn(t)
+		reader := bufio.NewReader(client)
+		payload := bytes.Repeat([]byte("x"), size)
+
+		go conn.WriteText(payload)
+		fin, opcode, got := readServerFrame(t, reader)
+		if !fin || opcode != wsText || !bytes.Equal(got, payload) {
+			t.Errorf("size %d: frame = (%t, %#x, %d bytes), want final text frame", size, fin, opcode, len(got))
+		}
+	}
+}
+
+func TestUpgradeWebSocket(t *testing.T) {
+	defer func(origins []string) {
+		SocketOrigins = origins
+	}(SocketOrigins)
+	SocketOrigins = []string{"http://kiosk.local:8080"}
+
+	upgraded := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgradeWebSocket(w, r)
+		if err == nil {
+			conn.Close()
+		}
+		upgraded <- err
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		origin string
+		status int
+	}{
+		{"no origin", "", http.StatusSwitchingProtocols},
+		{"same origin", server.URL, http.StatusSwitchingProtocols},
+		{"allowed origin", "http://kiosk.local:8080", http.StatusSwitchingProtocols},
+		{"cross origin", "http://evil.example", http.StatusForbidden},
+		{"allowed host with other scheme", "https://kiosk.local:8080", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+
+			client := &http.Client{Timeout: 5 * time.Second}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request: %s", err)
+			}
+			res.Body.Close()
+			<-upgraded
+
+			if res.StatusCode != test.status {
+				t.Fatalf("status = %d, want %d", res.StatusCode, test.status)
+			}
+			// the accept key from the example handshake in RFC 6455
+			if test.status == http.StatusSwitchingProtocols && res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+				t.Errorf("accept = %q", res.Header.Get("Sec-WebSocket-Accept"))
+			}
+		})
+	}
+}
+
+func TestForwardKegState(t *testing.T) {
+	flow, clock, _ := newTestFlow(t)
+	pour(flow, clock, defaultPourEventThreshold, 50*time.Millisecond)
+	clock.Advance(defaultDeltaThreshold)
+
+	previous := GlobalState
+	GlobalState = &State{Kegs: []*Flow{flow}}
+	defer func() { GlobalState = previous }()
+
+	conn, client := pipeConn(t)
+	socket := &socketClient{
+		conn:   conn,
+		topics: map[string]bool{TopicState: true},
+	}
+
+	// only the state of the keg the event belongs to is sent
+	done := make(chan error)
+	go func() {
+		done <- socket.forward(PourFinished{PourEvent{Pin: 17}})
+	}()
+
+	_, opcode, payload := readServerFrame(t, bufio.NewReader(client))
+	if err := <-done; err != nil {
+		t.Fatalf("forward: %s", err)
+	}
+	if opcode != wsText {
+		t.Fatalf("opcode = %#x, want text", opcode)
+	}
+
+	var message struct {
+		Type string    `json:"type"`
+		Data kegOutput `json:"data"`
+	}
+	err := json.Unmarshal(payload, &message)
+	if err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	if message.Type != socketKeg || message.Data.Pin != 17 || message.Data.Pulses != defaultPourEventThreshold {
+		t.Errorf("message = %s, want keg state for pin 17", payload)
+	}
+}